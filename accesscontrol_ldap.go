@@ -50,6 +50,7 @@ type ldapAccessControlConfiguration struct {
 	BindUsername   string `toml:"bind_username"`
 	BindPassword   string `toml:"bind_password"`
 	SearchTemplate string `toml:"search_template"`
+	MailAttribute  string `toml:"mail_attribute"`
 }
 
 type ldapAccessControlRetryable func() error
@@ -65,6 +66,10 @@ func (l *ldapAccessControl) Init(c *configuration, a AuthenticationInterface, e
 		return nil
 	}
 
+	l.config = ldapAccessControlConfiguration{
+		MailAttribute: "mail",
+	}
+
 	if err = c.UnifyAccessControlConfiguration(ldapAccessControlName, &l.config); err != nil {
 		log.Println("\tUnable to load configuration")
 		return
@@ -128,7 +133,8 @@ func (l *ldapAccessControl) middleware() echo.HandlerFunc {
 			return nil
 		}
 
-		if c.Request().Method == "POST" {
+		// Anything that isn't just looking needs permission
+		if method := c.Request().Method; method != "GET" && method != "HEAD" {
 			return l.Can(c)
 		}
 
@@ -178,6 +184,39 @@ func (l *ldapAccessControl) Can(c EchoStasher) error {
 	return echo.NewHTTPError(http.StatusUnauthorized)
 }
 
+// Mail looks user up with the search template, anybody who can enable a proxy will be found
+func (l *ldapAccessControl) Mail(c EchoStasher, user string) (string, error) {
+	if !l.enabled || l.config.MailAttribute == "" {
+		return "", nil
+	}
+	var searchFilterBuffer bytes.Buffer
+	if err := l.compiledSearchTemplate.Execute(&searchFilterBuffer, struct{ Username string }{Username: user}); err != nil {
+		return "", err
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		l.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.DerefAlways, 0, 0, false,
+		searchFilterBuffer.String(),
+		[]string{l.config.MailAttribute},
+		nil,
+	)
+
+	var searchResult *ldap.SearchResult
+	err := l.tryAndReconnect(func() (err error) {
+		searchResult, err = l.conn.Search(searchRequest)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(searchResult.Entries) != 1 {
+		return "", nil
+	}
+	return searchResult.Entries[0].GetAttributeValue(l.config.MailAttribute), nil
+}
+
 func init() {
 	RegisterAccessControlInterface(ldapAccessControlName, func() AccessControlInterface {
 		return &ldapAccessControl{}
@@ -0,0 +1,148 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// addressOverlay is the addresses added and removed through the admin interface, it's kept
+// apart from the configuration file so that can stay hand written, comments and all
+type addressOverlay struct {
+	Addresses ipAddressesConfiguration `toml:"address"`
+	Removed   []string                 `toml:"removed"`
+}
+
+// Serializes changes to the overlay and its file
+var overlayMutex sync.Mutex
+
+// loadAddressOverlay reads file, if there is one
+func loadAddressOverlay(file string) (addressOverlay, error) {
+	overlay := addressOverlay{}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return overlay, nil
+	}
+	_, err := toml.DecodeFile(file, &overlay)
+	return overlay, err
+}
+
+// apply makes the overlay's changes to addresses
+func (o addressOverlay) apply(addresses ipAddressesConfiguration) {
+	for _, ip := range o.Removed {
+		delete(addresses, ip)
+	}
+	for ip, address := range o.Addresses {
+		addresses[ip] = address
+	}
+}
+
+// recordAddress notes ip being added (or changed) or, when address is nil, removed and
+// writes the overlay out
+func recordAddress(ip string, address *ipAddressConfiguration) error {
+	overlayMutex.Lock()
+	defer overlayMutex.Unlock()
+
+	file := config().AddressesFile
+	if file == "" {
+		return nil
+	}
+	overlay, err := loadAddressOverlay(file)
+	if err != nil {
+		return err
+	}
+	if overlay.Addresses == nil {
+		overlay.Addresses = ipAddressesConfiguration{}
+	}
+	removed := overlay.Removed[:0]
+	for _, r := range overlay.Removed {
+		if r != ip {
+			removed = append(removed, r)
+		}
+	}
+	overlay.Removed = removed
+
+	if address != nil {
+		overlay.Addresses[ip] = *address
+	} else {
+		delete(overlay.Addresses, ip)
+		overlay.Removed = append(overlay.Removed, ip)
+	}
+
+	return saveAddressOverlay(file, overlay)
+}
+
+// removedAddresses is everything an admin has removed
+func removedAddresses() (map[string]bool, error) {
+	overlayMutex.Lock()
+	defer overlayMutex.Unlock()
+	removed := map[string]bool{}
+	if config().AddressesFile == "" {
+		return removed, nil
+	}
+	overlay, err := loadAddressOverlay(config().AddressesFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range overlay.Removed {
+		removed[ip] = true
+	}
+	return removed, nil
+}
+
+// saveAddressOverlay writes via a temporary file so a crash can't lose every address
+func saveAddressOverlay(file string, overlay addressOverlay) error {
+	writer, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer.WriteString("# Managed by zookeeper, addresses added and removed through the admin interface\n\n")
+	if err = toml.NewEncoder(writer).Encode(overlay); err != nil {
+		writer.Close()
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// validAddress checks ip is something that can be listened on
+func validAddress(ip string) error {
+	if net.ParseIP(ip) == nil {
+		return errors.New("Not an IP address")
+	}
+	return nil
+}
+
+// isAdmin is whether user is allowed to manage addresses
+func isAdmin(user string) bool {
+	for _, admin := range config().Admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
@@ -21,8 +21,15 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/GeertJohan/go.rice"
@@ -31,43 +38,90 @@ import (
 	"github.com/thoas/stats"
 )
 
-func adminInterface() (e *echo.Echo) {
-	log.Println("Administration interface starting")
-
-	assetHandler := http.FileServer(rice.MustFindBox("public").HTTPBox())
+// adminSecurity is the authentication and access control in use, it's built afresh and swapped in
+// on reload since middleware can't be taken back out of echo
+type adminSecurity struct {
+	authentication AuthenticationInterface
+	accessControl  AccessControlInterface
+	middleware     []echo.Middleware
+}
 
-	e = echo.New()
-	s := stats.New()
+var currentSecurity atomic.Value
 
-	e.Use(mw.Logger())
-	e.Use(mw.Recover())
-	e.Use(s.Handler)
+func newAdminSecurity(c *configuration) (*adminSecurity, error) {
+	s := &adminSecurity{}
 
 	log.Println("Configuring authentication interface")
-	var authInterface AuthenticationInterface
-	if config.AuthenticationMethod != "" {
-		authInterface = GetAuthenticationInterface(config.AuthenticationMethod)
-		if authInterface != nil {
-			err := authInterface.Init(config, e)
-			if err != nil {
+	if c.AuthenticationMethod != "" {
+		s.authentication = GetAuthenticationInterface(c.AuthenticationMethod)
+		if s.authentication != nil {
+			if err := s.authentication.Init(c, s); err != nil {
 				log.Println("Unable to initialize authentication module")
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
 
 	log.Println("Configuring accesscontrol interface")
-	var accessControlInterface AccessControlInterface
-	if config.AccessControlMethod != "" {
-		accessControlInterface = GetAccessControlInterface(config.AccessControlMethod)
-		if accessControlInterface != nil {
-			err := accessControlInterface.Init(config, authInterface, e)
-			if err != nil {
+	if c.AccessControlMethod != "" {
+		s.accessControl = GetAccessControlInterface(c.AccessControlMethod)
+		if s.accessControl != nil {
+			if err := s.accessControl.Init(c, s.authentication, s); err != nil {
 				log.Println("Unable to initialize access control module")
-				log.Fatal(err)
+				return nil, err
 			}
 		}
 	}
+	return s, nil
+}
+
+// Use collects the middleware the modules register
+func (s *adminSecurity) Use(m ...echo.Middleware) {
+	s.middleware = append(s.middleware, m...)
+}
+
+// check runs the collected middleware in order, stopping at the first to object
+func (s *adminSecurity) check(c *echo.Context) error {
+	for _, m := range s.middleware {
+		if h, ok := m.(echo.HandlerFunc); ok {
+			if err := h(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adminUser is whoever is making the request, nobody without authentication
+func adminUser(c *echo.Context) string {
+	if authInterface := currentSecurity.Load().(*adminSecurity).authentication; authInterface != nil {
+		if ok, user := authInterface.Authenticated(c); ok {
+			return user
+		}
+	}
+	return ""
+}
+
+func adminInterface() (e *echo.Echo) {
+	log.Println("Administration interface starting")
+
+	assetHandler := http.FileServer(rice.MustFindBox("public").HTTPBox())
+
+	e = echo.New()
+	s := stats.New()
+
+	e.Use(mw.Logger())
+	e.Use(mw.Recover())
+	e.Use(s.Handler)
+
+	security, err := newAdminSecurity(config())
+	if err != nil {
+		log.Fatal(err)
+	}
+	currentSecurity.Store(security)
+	e.Use(func(c *echo.Context) error {
+		return currentSecurity.Load().(*adminSecurity).check(c)
+	})
 
 	e.SetHTTPErrorHandler(func(err error, c *echo.Context) {
 		code := http.StatusInternalServerError
@@ -95,8 +149,156 @@ func adminInterface() (e *echo.Echo) {
 		return nil
 	})
 
+	// Only admins get to change which addresses there are or reload, without authentication there's no
+	// telling who anybody is so it's open like everything else
+	requireAdmin := func(c *echo.Context) error {
+		authInterface := currentSecurity.Load().(*adminSecurity).authentication
+		if authInterface == nil {
+			return nil
+		}
+		if ok, user := authInterface.Authenticated(c); ok && isAdmin(user) {
+			return nil
+		}
+		return echo.NewHTTPError(http.StatusForbidden, "Only admins can do that")
+	}
+
 	e.Get("/interfaces", func(c *echo.Context) error {
-		return c.JSON(http.StatusOK, config.Addresses)
+		return c.JSON(http.StatusOK, manager.addresses())
+	})
+
+	e.Get("/interfaces/:ip", func(c *echo.Context) error {
+		address, ok := manager.addresses()[c.Param("ip")]
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return c.JSON(http.StatusOK, address)
+	})
+
+	// Bind a new address
+	e.Post("/interfaces", func(c *echo.Context) error {
+		if err := requireAdmin(c); err != nil {
+			return err
+		}
+		add := struct {
+			IP string `json:"ip"`
+			ipAddressConfiguration
+		}{}
+		if err := c.Bind(&add); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err := validAddress(add.IP); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if manager.get(add.IP) != nil {
+			return echo.NewHTTPError(http.StatusConflict, "Interface already exists")
+		}
+
+		iface, err := manager.bind(add.IP, add.ipAddressConfiguration)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		iface.serve()
+		log.Printf("[%s] added", add.IP)
+
+		if err = recordAddress(add.IP, &add.ipAddressConfiguration); err != nil {
+			log.Printf("[%s] Unable to save addresses: %s", add.IP, err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Added but unable to save addresses")
+		}
+		return c.JSON(http.StatusOK, ipAddressesConfiguration{add.IP: add.ipAddressConfiguration})
+	})
+
+	// Change an address's description
+	e.Post("/interfaces/:ip", func(c *echo.Context) error {
+		if err := requireAdmin(c); err != nil {
+			return err
+		}
+		ip := c.Param("ip")
+		address := ipAddressConfiguration{}
+		if err := c.Bind(&address); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err := manager.describe(ip, address); err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+
+		if err := recordAddress(ip, &address); err != nil {
+			log.Printf("[%s] Unable to save addresses: %s", ip, err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Changed but unable to save addresses")
+		}
+		return c.JSON(http.StatusOK, address)
+	})
+
+	// Stop listening on an address, anything in flight is drained first
+	e.Delete("/interfaces/:ip", func(c *echo.Context) error {
+		if err := requireAdmin(c); err != nil {
+			return err
+		}
+		ip := c.Param("ip")
+		if err := manager.remove(ip); err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		log.Printf("[%s] removed", ip)
+
+		if err := recordAddress(ip, nil); err != nil {
+			log.Printf("[%s] Unable to save addresses: %s", ip, err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Removed but unable to save addresses")
+		}
+		return c.JSON(http.StatusOK, manager.addresses())
+	})
+
+	e.Post("/reload", func(c *echo.Context) error {
+		if err := requireAdmin(c); err != nil {
+			return err
+		}
+		report, err := reloadConfiguration()
+		if err != nil {
+			log.Println("Unable to reload configuration:", err)
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, report)
+	})
+
+	// Everybody looks after their own notification preferences, so there has to be a somebody
+	e.Get("/notifications", func(c *echo.Context) error {
+		user := adminUser(c)
+		if user == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "Notification preferences need authentication")
+		}
+		preferences, err := getPreferences(user)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, preferences)
+	})
+
+	e.Post("/notifications", func(c *echo.Context) error {
+		user := adminUser(c)
+		if user == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "Notification preferences need authentication")
+		}
+		// Preferences are replicated like proxies, so they're changed on the leader too
+		if cluster.standby() {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "This is a standby, make changes on the leader "+cluster.leaderAdmin())
+		}
+		preferences := &notificationPreferences{}
+		if err := c.Bind(preferences); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err := preferences.validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err := setPreferences(user, preferences); err != nil {
+			log.Printf("Unable to save notification preferences for %s: %s", user, err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, preferences)
+	})
+
+	e.Get("/cluster", func(c *echo.Context) error {
+		if cluster == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Not clustered")
+		}
+		return c.JSON(http.StatusOK, cluster.status())
 	})
 
 	e.Get("/stats", func(c *echo.Context) error {
@@ -105,22 +307,113 @@ func adminInterface() (e *echo.Echo) {
 
 	g := e.Group("/proxy")
 	g.Use(func(c *echo.Context) error {
-		if _, ok := metaData[c.Param("ip")]; !ok {
+		if manager.get(c.Param("ip")) == nil {
 			return echo.NewHTTPError(http.StatusNotFound)
 		}
+		// Changes are made on the cluster leader, it replicates them
+		if method := c.Request().Method; method != "GET" && method != "HEAD" && cluster.standby() {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "This is a standby, make changes on the leader "+cluster.leaderAdmin())
+		}
 		return nil
 	})
 
 	g.Get("/:ip", func(c *echo.Context) error {
+		return c.JSON(http.StatusOK, manager.get(c.Param("ip")).view())
+	})
+
+	// Try out rewrite rules, either the ones given or the proxy's own, against a URL
+	g.Post("/:ip/rewrite", func(c *echo.Context) error {
 		data := getData(c.Param("ip"))
-		return c.JSON(http.StatusOK, data)
+		test := struct {
+			URL      string
+			Rewrites []*rewriteRule
+		}{}
+		if err := c.Bind(&test); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		rules := data.Rewrites
+		if test.Rewrites != nil {
+			if err := compileRewrites(test.Rewrites); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			rules = test.Rewrites
+		}
+
+		u, err := url.ParseRequestURI(test.URL)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid URL")
+		}
+		original := u.String()
+		applied := rewriteURL(rules, u)
+
+		result := struct {
+			Original  string
+			Rewritten string
+			Forwarded string `json:",omitempty"`
+			Applied   []int
+		}{Original: original, Rewritten: u.String(), Applied: applied}
+		if data.TargetURL.URL != nil {
+			forwarded := *data.TargetURL.URL
+			forwarded.Path = singleJoiningSlash(forwarded.Path, u.Path)
+			if forwarded.RawQuery == "" || u.RawQuery == "" {
+				forwarded.RawQuery += u.RawQuery
+			} else {
+				forwarded.RawQuery += "&" + u.RawQuery
+			}
+			result.Forwarded = forwarded.String()
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	g.Post("/:ip/check", func(c *echo.Context) error {
+		return c.JSON(http.StatusOK, runHealthCheck(c.Param("ip")))
 	})
 
 	g.Post("/:ip", func(c *echo.Context) error {
+		ip := c.Param("ip")
+		iface := manager.get(ip)
+		data, err := iface.update(func(data *proxyData) error {
+			data.SetHeader = http.Header{}
+			// Only the settings, expiry and the like are only changed by enabling
+			if err := c.Bind(&data.proxySettings); err != nil {
+				return err
+			}
+			if data.Queue && getQueue(ip) == nil {
+				return errors.New("Queueing isn't configured")
+			}
+			return nil
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		note := newNotification(eventUpdated, ip, data)
+		note.By = adminUser(c)
+		notify(note)
+		return c.JSON(http.StatusOK, iface.view())
+	})
+
+	// Faults get their own endpoint so they can be flipped on and off without resending everything else
+	g.Get("/:ip/faults", func(c *echo.Context) error {
 		data := getData(c.Param("ip"))
-		data.SetHeader = http.Header{}
-		c.Bind(data)
-		return c.JSON(http.StatusOK, data)
+		return c.JSON(http.StatusOK, data.Faults)
+	})
+
+	g.Post("/:ip/faults", func(c *echo.Context) error {
+		ip := c.Param("ip")
+		faults := []*faultRule{}
+		if err := c.Bind(&faults); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		iface := manager.get(ip)
+		_, err := iface.update(func(data *proxyData) error {
+			data.Faults = faults
+			return nil
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		log.Printf("[%s] %d fault rules set", ip, len(faults))
+		return c.JSON(http.StatusOK, iface.view())
 	})
 
 	/* - Simplified the api a bit... might revisit
@@ -149,31 +442,205 @@ func adminInterface() (e *echo.Echo) {
 		return c.JSON(http.StatusOK, data)
 	}) */
 
+	g.Get("/:ip/traffic", func(c *echo.Context) error {
+		filter, err := trafficFilterParams(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, filterTraffic(getTrafficLog(c.Param("ip")).list(), filter))
+	})
+
+	g.Get("/:ip/har", func(c *echo.Context) error {
+		ip := c.Param("ip")
+		filter, err := trafficFilterParams(c)
+		if err != nil {
+			return err
+		}
+		filename := fmt.Sprintf("zookeeper-%s-%s.har", ip, time.Now().Format("20060102-150405"))
+		c.Response().Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+		return c.JSON(http.StatusOK, buildHAR(filterTraffic(getTrafficLog(ip).list(), filter)))
+	})
+
+	g.Get("/:ip/traffic/:id", func(c *echo.Context) error {
+		record, err := trafficRecordParam(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, record)
+	})
+
+	g.Get("/:ip/traffic/:id/diff", func(c *echo.Context) error {
+		record, err := trafficRecordParam(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, diffRecord(record))
+	})
+
+	g.Get("/:ip/queue", func(c *echo.Context) error {
+		q, err := queueParam(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, q.list())
+	})
+
+	g.Delete("/:ip/queue", func(c *echo.Context) error {
+		q, err := queueParam(c)
+		if err != nil {
+			return err
+		}
+		log.Printf("[%s] purged %d queued requests", q.ip, q.purge())
+		return c.JSON(http.StatusOK, q.list())
+	})
+
+	g.Post("/:ip/queue/redeliver", func(c *echo.Context) error {
+		q, err := queueParam(c)
+		if err != nil {
+			return err
+		}
+		for _, item := range q.list() {
+			if _, err := q.redeliver(item.ID); err != nil && err != errQueueDelivering {
+				break
+			}
+		}
+		return c.JSON(http.StatusOK, q.list())
+	})
+
+	g.Delete("/:ip/queue/:id", func(c *echo.Context) error {
+		q, err := queueParam(c)
+		if err != nil {
+			return err
+		}
+		if !q.remove(c.Param("id")) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return c.JSON(http.StatusOK, q.list())
+	})
+
+	g.Post("/:ip/queue/:id/redeliver", func(c *echo.Context) error {
+		q, err := queueParam(c)
+		if err != nil {
+			return err
+		}
+		result, err := q.redeliver(c.Param("id"))
+		if os.IsNotExist(err) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		if result == nil && err != nil {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
 	g.Post("/:ip/enable", func(c *echo.Context) error {
 		ip := c.Param("ip")
-		data := getData(ip)
-		previous := data.Enabled
-		c.Bind(&data.Enabled)
+		iface := manager.get(ip)
+		request := enableRequest{}
+		if err := c.Bind(&request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
 
-		updateProxy := func() {
-			data.Expire = time.Now().Add(config.MaxTTL.Duration)
-			if authInterface != nil {
-				_, user := authInterface.Authenticated(c)
-				data.Who = user
+		if !request.Enable {
+			if iface.data().Enabled {
+				reason := "Disabled"
+				user := adminUser(c)
+				if user != "" {
+					reason = "Disabled by " + user
+				}
+				if _, err := iface.disable(reason, user); err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+				}
 			}
+			return c.JSON(http.StatusOK, iface.view())
 		}
 
-		if previous != data.Enabled {
-			if data.Enabled {
-				proxies[ip].Handler = proxyUpInterface(ip)
-				updateProxy()
-			} else {
-				proxies[ip].Handler = proxyDownInterface(ip)
+		user := ""
+		authInterface := currentSecurity.Load().(*adminSecurity).authentication
+		if authInterface != nil {
+			_, user = authInterface.Authenticated(c)
+		}
+		expire, clamped, err := request.expiry(ip, user, time.Now())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if clamped {
+			log.Printf("[%s] %s asked for longer than they're allowed, expiring at %s", ip, user, expire)
+		}
+
+		// Enabling and extending are the same thing, a new expiry and a restarted timer
+		event := eventExtended
+		if !iface.data().Enabled {
+			event = eventEnabled
+			if mode := iface.data().Mode; mode == "" || mode == modeProxy {
+				// Pre-flight, it doesn't stop the proxy coming up but it lets them know straight away
+				runHealthCheck(ip)
 			}
-		} else if data.Enabled {
-			updateProxy()
 		}
-		return c.JSON(http.StatusOK, data)
+		_, err = iface.update(func(data *proxyData) error {
+			data.Expire = expire
+			if authInterface != nil {
+				data.Who = user
+				data.WhoMail = resolveMail(c, user)
+			}
+			return nil
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		data, err := iface.enable()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		note := newNotification(event, ip, data)
+		note.By = user
+		notify(note)
+		return c.JSON(http.StatusOK, iface.view())
 	})
 	return
 }
+
+func trafficRecordParam(c *echo.Context) (*trafficRecord, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid traffic id")
+	}
+	record := getTrafficLog(c.Param("ip")).get(id)
+	if record == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound)
+	}
+	return record, nil
+}
+
+func trafficFilterParams(c *echo.Context) (filter *trafficFilter, err error) {
+	filter = &trafficFilter{Method: c.Query("method")}
+	if from := c.Query("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid from, expected RFC3339")
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid to, expected RFC3339")
+		}
+	}
+	if path := c.Query("path"); path != "" {
+		if filter.Path, err = regexp.Compile(path); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid path expression")
+		}
+	}
+	if status := c.Query("status"); status != "" {
+		if filter.Status, err = strconv.Atoi(status); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid status")
+		}
+	}
+	return filter, nil
+}
+
+func queueParam(c *echo.Context) (*deliveryQueue, error) {
+	q := getQueue(c.Param("ip"))
+	if q == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Queueing isn't configured")
+	}
+	return q, nil
+}
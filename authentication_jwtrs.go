@@ -43,6 +43,7 @@ type jwtrsAuthenticationConfiguration struct {
 	Header        string  `toml:"header"`
 	UsernameClaim string  `toml:"username_claim"`
 	StashKey      string  `toml:"stash_key"`
+	MailClaim     string  `toml:"mail_claim"`
 }
 
 func (a *jwtrsAuthentication) Init(c *configuration, e EchoMiddlewareUser) (err error) {
@@ -51,6 +52,7 @@ func (a *jwtrsAuthentication) Init(c *configuration, e EchoMiddlewareUser) (err
 		Header:        "X-User-Authenticate",
 		UsernameClaim: "user",
 		StashKey:      "claims",
+		MailClaim:     "email",
 	}
 
 	if err = c.UnifyAuthenticationConfiguration(jwtrsAuthenticationName, &a.config); err != nil {
@@ -125,6 +127,16 @@ func (a *jwtrsAuthentication) Authenticated(c EchoStasher) (bool, string) {
 	return false, ""
 }
 
+// Mail is the address in the token, user is who it's for and it's always them
+func (a *jwtrsAuthentication) Mail(c EchoStasher, user string) (string, error) {
+	if claims, ok := c.Get(a.config.StashKey).(map[string]interface{}); ok {
+		if mail, ok := claims[a.config.MailClaim].(string); ok {
+			return mail, nil
+		}
+	}
+	return "", nil
+}
+
 func init() {
 	RegisterAuthenticationInterface(jwtrsAuthenticationName, func() AuthenticationInterface {
 		return &jwtrsAuthentication{}
@@ -0,0 +1,90 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// requestBudget takes the proxy down once Limit matching requests have come in, for callbacks
+// that only ever need a handful
+type requestBudget struct {
+	requestMatcher
+	Limit int
+}
+
+func (b *requestBudget) compile() error {
+	if b == nil {
+		return nil
+	}
+	if b.Limit < 0 {
+		return errors.New("Request budget can't be negative")
+	}
+	return b.requestMatcher.compile()
+}
+
+// same is whether o counts the same requests to the same limit
+func (b *requestBudget) same(o *requestBudget) bool {
+	if b == nil || o == nil {
+		return b == o
+	}
+	return b.Limit == o.Limit && b.Method == o.Method && b.Path == o.Path
+}
+
+// budgetRemaining is how many more matching requests the proxy will take, nil without a budget
+func (i *proxyInterface) budgetRemaining() *int64 {
+	budget := i.data().Budget
+	if budget == nil || budget.Limit == 0 {
+		return nil
+	}
+	remaining := int64(budget.Limit) - atomic.LoadInt64(&i.budgetUsed)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &remaining
+}
+
+// budgeted counts matching requests against the budget, the one that uses it up is still served
+// but the proxy is disabled as it goes through so nothing after it is
+func (i *proxyInterface) budgeted(stop chan bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget := i.data().Budget
+		if budget == nil || budget.Limit == 0 || budget.match(r) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		used := atomic.AddInt64(&i.budgetUsed, 1)
+		if used > int64(budget.Limit) {
+			// Got in just as the last one was disabling it
+			proxyDownInterface(i.ip).ServeHTTP(w, r)
+			return
+		}
+		if used == int64(budget.Limit) {
+			log.Printf("[%s] %s %s %s used up the request budget", i.ip, clientIP(r), r.Host, r.URL.String())
+			i.disableIf(stop, "Request budget used up")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,376 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+)
+
+const clusterApplyTimeout = 10 * time.Second
+
+type clusterConfiguration struct {
+	NodeID    string                 `toml:"node_id"`
+	Directory string                 `toml:"directory"`
+	Peers     map[string]clusterPeer `toml:"peers"`
+}
+
+// clusterPeer is a member of the cluster, this one included
+type clusterPeer struct {
+	Raft  string `toml:"raft" json:"raft"`
+	Admin string `toml:"admin" json:"admin"`
+}
+
+func (c clusterConfiguration) enabled() bool {
+	return c.NodeID != ""
+}
+
+// clusterNode replicates every proxy's data to the rest of the cluster with raft. Only the
+// leader listens on the addresses and takes changes, the rest wait in standby with a copy
+type clusterNode struct {
+	id      string
+	peers   map[string]clusterPeer
+	raft    *raft.Raft
+	store   *raftboltdb.BoltStore
+	leading int32
+}
+
+// The cluster this is part of, nil when it's on its own
+var cluster *clusterNode
+
+// clusterCommand is an entry in the replicated log, the data an interface now has or the
+// notification preferences a user now has
+type clusterCommand struct {
+	IP          string                   `json:",omitempty"`
+	Data        *proxyData               `json:",omitempty"`
+	User        string                   `json:",omitempty"`
+	Preferences *notificationPreferences `json:",omitempty"`
+}
+
+// clusterSnapshot is every interface's data and everybody's notification preferences, what a
+// new or lagging member starts from
+type clusterSnapshot struct {
+	Proxies     map[string]*proxyData
+	Preferences map[string]*notificationPreferences
+}
+
+// newClusterNode is a member that hasn't joined yet. It's a standby until it's elected, so
+// interfaces can be added without listening before it joins
+func newClusterNode(c clusterConfiguration) (*clusterNode, error) {
+	if _, ok := c.Peers[c.NodeID]; !ok {
+		return nil, errors.New("node_id has to be one of the peers")
+	}
+	return &clusterNode{id: c.NodeID, peers: c.Peers}, nil
+}
+
+// join starts raft. Every interface has to have been added first, raft restores the last
+// snapshot into them before it returns and anything without an interface is dropped
+func (n *clusterNode) join(c clusterConfiguration) error {
+	self := c.Peers[c.NodeID]
+	dir := filepath.Join(c.Directory, c.NodeID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", self.Raft)
+	if err != nil {
+		return err
+	}
+	transport, err := raft.NewTCPTransport(self.Raft, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(c.NodeID)
+	// The log and the current term and vote are kept on disk, forgetting who it voted for could
+	// have it vote twice in a term and end up with two leaders
+	if n.store, err = raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db")); err != nil {
+		return err
+	}
+	if n.raft, err = raft.NewRaft(conf, n, n.store, n.store, snapshots, transport); err != nil {
+		n.store.Close()
+		return err
+	}
+
+	ids := make([]string, 0, len(c.Peers))
+	for id := range c.Peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	servers := make([]raft.Server, 0, len(ids))
+	for _, id := range ids {
+		servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(c.Peers[id].Raft)})
+	}
+	// Every member bootstraps with the same peers, it's refused once there's history
+	if err = n.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && err != raft.ErrCantBootstrap {
+		return err
+	}
+	return nil
+}
+
+// standby is whether this is a cluster member that isn't in charge
+func (n *clusterNode) standby() bool {
+	return n != nil && atomic.LoadInt32(&n.leading) == 0
+}
+
+// leaderAdmin is the leader's admin interface, if there is a leader
+func (n *clusterNode) leaderAdmin() string {
+	leader := string(n.raft.Leader())
+	for _, peer := range n.peers {
+		if peer.Raft == leader {
+			return peer.Admin
+		}
+	}
+	return ""
+}
+
+// publish replicates a change made on the leader, standbys don't make changes of their own
+func (n *clusterNode) publish(ip string, data *proxyData) {
+	if n == nil || n.standby() {
+		return
+	}
+	encoded, err := json.Marshal(clusterCommand{IP: ip, Data: data})
+	if err != nil {
+		log.Printf("[%s] Unable to replicate: %s", ip, err)
+		return
+	}
+	future := n.raft.Apply(encoded, clusterApplyTimeout)
+	go func() {
+		if err := future.Error(); err != nil {
+			log.Printf("[%s] Unable to replicate: %s", ip, err)
+		}
+	}()
+}
+
+// publishPreferences replicates a user's notification preferences, whoever leads next needs them
+func (n *clusterNode) publishPreferences(user string, p *notificationPreferences) {
+	if n == nil || n.standby() {
+		return
+	}
+	encoded, err := json.Marshal(clusterCommand{User: user, Preferences: p})
+	if err != nil {
+		log.Printf("Unable to replicate notification preferences for %s: %s", user, err)
+		return
+	}
+	future := n.raft.Apply(encoded, clusterApplyTimeout)
+	go func() {
+		if err := future.Error(); err != nil {
+			log.Printf("Unable to replicate notification preferences for %s: %s", user, err)
+		}
+	}()
+}
+
+// Apply is raft.FSM, the leader already has what it's replicating
+func (n *clusterNode) Apply(entry *raft.Log) interface{} {
+	command := clusterCommand{}
+	if err := json.Unmarshal(entry.Data, &command); err != nil {
+		log.Println("Cluster: unable to decode log entry:", err)
+		return err
+	}
+	if !n.standby() {
+		return nil
+	}
+	if command.User != "" {
+		if err := storePreferences(command.User, command.Preferences); err != nil {
+			log.Printf("Unable to keep replicated notification preferences for %s: %s", command.User, err)
+		}
+		return nil
+	}
+	replicate(command.IP, command.Data)
+	return nil
+}
+
+// Snapshot is raft.FSM, snapshots are never modified so there's no need to copy
+func (n *clusterNode) Snapshot() (raft.FSMSnapshot, error) {
+	preferences, err := allPreferences()
+	if err != nil {
+		return nil, err
+	}
+	return &clusterSnapshot{Proxies: manager.snapshot(), Preferences: preferences}, nil
+}
+
+// Restore is raft.FSM
+func (n *clusterNode) Restore(reader io.ReadCloser) error {
+	defer reader.Close()
+	snapshot := clusterSnapshot{}
+	if err := json.NewDecoder(reader).Decode(&snapshot); err != nil {
+		return err
+	}
+	if !n.standby() {
+		return nil
+	}
+	for ip, data := range snapshot.Proxies {
+		replicate(ip, data)
+	}
+	if snapshot.Preferences != nil {
+		if err := replacePreferences(snapshot.Preferences); err != nil {
+			log.Println("Cluster: unable to keep notification preferences:", err)
+		}
+	}
+	return nil
+}
+
+func (s *clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *clusterSnapshot) Release() {}
+
+// replicate takes on data from the leader, it's only kept, a standby has nothing to enable
+func replicate(ip string, data *proxyData) {
+	iface := manager.get(ip)
+	if iface == nil || data == nil {
+		log.Printf("\tInterface %s doesn't exist, ignoring replicated data", ip)
+		return
+	}
+	data.restore(ip)
+	if err := data.validate(); err != nil {
+		log.Printf("[%s] Unable to use replicated data: %s", ip, err)
+		return
+	}
+	iface.mutex.Lock()
+	iface.current.Store(data)
+	iface.mutex.Unlock()
+}
+
+// watch takes charge or stands down as leadership comes and goes
+func (n *clusterNode) watch() {
+	for leading := range n.raft.LeaderCh() {
+		if leading {
+			n.lead()
+		} else {
+			n.standDown()
+		}
+	}
+}
+
+// lead takes charge of every interface once everything the last leader did has been applied
+func (n *clusterNode) lead() {
+	log.Println("Cluster: elected leader, taking charge")
+	if err := n.raft.Barrier(clusterApplyTimeout).Error(); err != nil {
+		log.Println("Cluster: unable to catch up, not taking charge:", err)
+		return
+	}
+	atomic.StoreInt32(&n.leading, 1)
+	for _, ip := range manager.ips() {
+		if iface := manager.get(ip); iface != nil {
+			go iface.takeCharge()
+		}
+	}
+}
+
+// standDown stops listening everywhere, letting what's in flight drain
+func (n *clusterNode) standDown() {
+	if !atomic.CompareAndSwapInt32(&n.leading, 1, 0) {
+		return
+	}
+	log.Println("Cluster: no longer leader, standing by")
+	manager.shutdown()
+}
+
+// stop leaves the cluster, somebody else takes charge if this was the leader
+func (n *clusterNode) stop() {
+	if n == nil || n.raft == nil {
+		return
+	}
+	atomic.StoreInt32(&n.leading, 0)
+	if err := n.raft.Shutdown().Error(); err != nil {
+		log.Println("Cluster: unable to shut down:", err)
+	}
+	if err := n.store.Close(); err != nil {
+		log.Println("Cluster: unable to close the log:", err)
+	}
+}
+
+// takeCharge listens, waiting for the old leader to let go of the address if it has to, and
+// brings the proxy back up as the leader left it
+func (i *proxyInterface) takeCharge() {
+	for {
+		if cluster.standby() {
+			return
+		}
+		err := i.listen()
+		if err == nil {
+			break
+		}
+		log.Printf("[%s] Unable to listen, trying again: %s", i.ip, err)
+		time.Sleep(time.Second)
+	}
+	if cluster.standby() {
+		// Stood down while waiting, nothing has been served so there's nothing to wait for
+		i.shutdown(context.Background())
+		return
+	}
+
+	data := i.data()
+	switch {
+	case data.Enabled && data.Expire.After(time.Now()):
+		i.enable()
+	case data.Enabled:
+		i.disable(reasonExpired, "")
+	default:
+		i.setHandler(proxyDownInterface(i.ip))
+	}
+	if i.queue != nil {
+		i.queue.start()
+	}
+	i.reschedule()
+	i.serve()
+}
+
+// clusterStatus is what /cluster shows
+type clusterStatus struct {
+	NodeID      string
+	State       string
+	Leader      string
+	LeaderAdmin string
+	Peers       map[string]clusterPeer
+}
+
+func (n *clusterNode) status() *clusterStatus {
+	return &clusterStatus{
+		NodeID:      n.id,
+		State:       n.raft.State().String(),
+		Leader:      string(n.raft.Leader()),
+		LeaderAdmin: n.leaderAdmin(),
+		Peers:       n.peers,
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const clusterTestAddress = "127.0.0.2"
+
+var clusterTestPeers = map[string]clusterPeer{
+	"zk1": {Raft: "127.0.0.1:17001", Admin: "http://127.0.0.1:18081"},
+	"zk2": {Raft: "127.0.0.1:17002", Admin: "http://127.0.0.1:18082"},
+	"zk3": {Raft: "127.0.0.1:17003", Admin: "http://127.0.0.1:18083"},
+}
+
+// TestClusterOnLocalhost runs three zookeepers as separate processes sharing one address on
+// loopback. The leader is killed and a standby has to bring the proxy back up, then the old
+// leader is started again and has to come back as a standby that knows about the proxy. Only
+// the leader listens so they can share the address, but it's port 443 so this only runs when
+// ZOOKEEPER_CLUSTER_TEST is set
+func TestClusterOnLocalhost(t *testing.T) {
+	if os.Getenv("ZOOKEEPER_CLUSTER_TEST") == "" {
+		t.Skip("Set ZOOKEEPER_CLUSTER_TEST to run, it has to be able to listen on port 443")
+	}
+
+	dir, err := ioutil.TempDir("", "zookeeper-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binary := filepath.Join(dir, "zookeeper")
+	if output, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("Unable to build: %s\n%s", err, output)
+	}
+	if err = writeTestCertificate(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	running := map[string]*exec.Cmd{}
+	defer func() {
+		for _, cmd := range running {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}()
+	start := func(id string) {
+		cmd, err := startTestMember(dir, binary, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		running[id] = cmd
+	}
+	for id := range clusterTestPeers {
+		start(id)
+	}
+
+	leader := waitForLeader(t, running)
+	admin := clusterTestPeers[leader].Admin
+	if err = postTestJSON(admin+"/proxy/"+clusterTestAddress, map[string]interface{}{
+		"TargetURL": "https://example.com",
+		"Comment":   "cluster test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = postTestJSON(admin+"/proxy/"+clusterTestAddress+"/enable", map[string]interface{}{
+		"Enable": true,
+		"TTL":    "1h",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// No chance to hand over, as if the box went away
+	running[leader].Process.Kill()
+	running[leader].Wait()
+	delete(running, leader)
+
+	next := waitForLeader(t, running)
+	waitForTestProxy(t, clusterTestPeers[next].Admin, true)
+	waitFor(t, "the new leader to listen", func() bool {
+		conn, err := tls.Dial("tcp", net.JoinHostPort(clusterTestAddress, "443"), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+
+	// Back from the dead it has to catch up, not come up empty
+	start(leader)
+	waitFor(t, leader+" to stand by", func() bool {
+		status := clusterStatus{}
+		return getTestJSON(clusterTestPeers[leader].Admin+"/cluster", &status) == nil && status.State == "Follower"
+	})
+	waitForTestProxy(t, clusterTestPeers[leader].Admin, true)
+}
+
+func startTestMember(dir, binary, id string) (*exec.Cmd, error) {
+	config := &bytes.Buffer{}
+	fmt.Fprintf(config, "listen = %q\n", strings.TrimPrefix(clusterTestPeers[id].Admin, "http://"))
+	fmt.Fprintf(config, "max_ttl = \"4h\"\naddresses_file = \"\"\n\n")
+	fmt.Fprintf(config, "[tls]\ncertificate = \"file://cert.pem\"\nkey = \"file://key.pem\"\n\n")
+	fmt.Fprintf(config, "[notifications]\npreferences_file = \"\"\n\n")
+	fmt.Fprintf(config, "[address.%q]\ndescription = \"cluster test\"\n\n", clusterTestAddress)
+	fmt.Fprintf(config, "[cluster]\nnode_id = %q\ndirectory = \"cluster\"\n\n", id)
+	for peer, c := range clusterTestPeers {
+		fmt.Fprintf(config, "[cluster.peers.%s]\nraft = %q\nadmin = %q\n\n", peer, c.Raft, c.Admin)
+	}
+	file := id + ".toml"
+	if err := ioutil.WriteFile(filepath.Join(dir, file), config.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+
+	output, err := os.OpenFile(filepath.Join(dir, id+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(binary, "-config", file)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = output, output
+	return cmd, cmd.Start()
+}
+
+// waitForLeader is whichever of running says it's the leader
+func waitForLeader(t *testing.T, running map[string]*exec.Cmd) (leader string) {
+	waitFor(t, "a leader", func() bool {
+		for id := range running {
+			status := clusterStatus{}
+			if getTestJSON(clusterTestPeers[id].Admin+"/cluster", &status) == nil && status.State == "Leader" {
+				leader = id
+				return true
+			}
+		}
+		return false
+	})
+	return
+}
+
+func waitForTestProxy(t *testing.T, admin string, enabled bool) {
+	waitFor(t, admin+" to have the proxy", func() bool {
+		view := map[string]interface{}{}
+		return getTestJSON(admin+"/proxy/"+clusterTestAddress, &view) == nil && view["Enabled"] == enabled && view["Comment"] == "cluster test"
+	})
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(30 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Gave up waiting for %s", what)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func getTestJSON(url string, v interface{}) error {
+	res, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func postTestJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	res, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s answered %d: %s", url, res.StatusCode, message)
+	}
+	return nil
+}
+
+// writeTestCertificate makes a self signed cert.pem and key.pem in dir
+func writeTestCertificate(dir string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: clusterTestAddress},
+		IPAddresses:  []net.IP{net.ParseIP(clusterTestAddress)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	encodedKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encodedKey}), 0600)
+}
@@ -23,6 +23,7 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"sync/atomic"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -37,22 +38,95 @@ type configuration struct {
 	AccessControlMethod  string                    `toml:"accesscontrol_method"`
 	AccessControlConfig  map[string]toml.Primitive `toml:"accesscontrol"`
 	Addresses            ipAddressesConfiguration  `toml:"address"`
+	AddressesFile        string                    `toml:"addresses_file"`
+	Discovery            discoveryConfiguration    `toml:"discovery"`
+	Cluster              clusterConfiguration      `toml:"cluster"`
+	Admins               []string                  `toml:"admins"`
 	StateSaver           stateSaverConfiguration   `toml:"statesaver"`
 	MaxTTL               duration                  `toml:"max_ttl"`
+	TTL                  ttlConfiguration          `toml:"ttl"`
+	Traffic              trafficConfiguration      `toml:"traffic"`
+	Queue                queueConfiguration        `toml:"queue"`
+	HealthCheck          healthCheckConfiguration  `toml:"healthcheck"`
+	DrainTimeout         duration                  `toml:"drain_timeout"`
+	Notifications        notificationConfiguration `toml:"notifications"`
+	NotifierConfig       map[string]toml.Primitive `toml:"notifier"`
+
+	// Where it was loaded from and what was in it, for reloading
+	file string
+	raw  map[string]interface{}
+}
+
+var currentConfig atomic.Value
+
+// config is the configuration in use. It's replaced wholesale on reload and never modified once
+// it's in use, so hang on to what it returns when things need to stay consistent
+func config() *configuration {
+	return currentConfig.Load().(*configuration)
+}
+
+func setConfig(c *configuration) {
+	currentConfig.Store(c)
 }
 
 func loadConfiguration(file string) (*configuration, error) {
 	var err error
 	config := configuration{
-		Listen: ":8080",
+		file:          file,
+		Listen:        ":8080",
+		AddressesFile: ".addresses",
+		DrainTimeout:  duration{30 * time.Second},
+		Traffic: trafficConfiguration{
+			History:   100,
+			BodyLimit: 64 * 1024,
+		},
+		Queue: queueConfiguration{
+			MaxBody:  10 << 20,
+			RetryMin: duration{5 * time.Second},
+			RetryMax: duration{5 * time.Minute},
+		},
+		HealthCheck: healthCheckConfiguration{
+			Interval: duration{30 * time.Second},
+			Timeout:  duration{5 * time.Second},
+		},
+		Discovery: discoveryConfiguration{
+			Interval: duration{time.Minute},
+		},
+		Cluster: clusterConfiguration{
+			Directory: ".cluster",
+		},
+		Notifications: notificationConfiguration{
+			ExpiryWarnings:  []duration{{15 * time.Minute}},
+			PreferencesFile: ".notifications",
+		},
+	}
+	if config.md, err = toml.DecodeFile(file, &config); err != nil {
+		return &config, err
 	}
-	config.md, err = toml.DecodeFile(file, &config)
-	return &config, err
+	if _, err = toml.DecodeFile(file, &config.raw); err != nil {
+		return &config, err
+	}
+	if config.Traffic.BodyLimit <= 0 {
+		return &config, fmt.Errorf("traffic.body_limit must be greater than 0")
+	}
+
+	if config.Addresses == nil {
+		config.Addresses = ipAddressesConfiguration{}
+	}
+	if config.AddressesFile != "" {
+		overlay, err := loadAddressOverlay(config.AddressesFile)
+		if err != nil {
+			return &config, fmt.Errorf("Unable to read %s: %s", config.AddressesFile, err)
+		}
+		overlay.apply(config.Addresses)
+	}
+	return &config, nil
 }
 
 type tlsConfiguration struct {
-	Certificate keyFile `toml:"certificate"`
-	Key         keyFile `toml:"key"`
+	Certificate  keyFile `toml:"certificate"`
+	Key          keyFile `toml:"key"`
+	DisableHTTP2 bool    `toml:"disable_http2"`
 }
 
 type jwtConfiguration struct {
@@ -80,6 +154,9 @@ type ipAddressesConfiguration map[string]ipAddressConfiguration
 
 type ipAddressConfiguration struct {
 	Description string `toml:"description" json:"description"`
+	// Found by discovery rather than configured, and where
+	Discovered bool   `toml:"-" json:"discovered"`
+	Interface  string `toml:"-" json:"interface,omitempty"`
 }
 
 func (c *configuration) UnifyAuthenticationConfiguration(name string, v interface{}) (err error) {
@@ -96,6 +173,18 @@ func (c *configuration) UnifyAccessControlConfiguration(name string, v interface
 	return
 }
 
+func (c *configuration) UnifyNotifierConfiguration(name string, v interface{}) (err error) {
+	if c.md.IsDefined("notifier", name) {
+		err = c.md.PrimitiveDecode(c.NotifierConfig[name], v)
+	}
+	return
+}
+
+type trafficConfiguration struct {
+	History   int `toml:"history"`
+	BodyLimit int `toml:"body_limit"`
+}
+
 type stateSaverConfiguration struct {
 	Enabled  bool      `toml:"enabled"`
 	Interval *duration `toml:"interval"`
@@ -108,6 +197,17 @@ type duration struct {
 
 func (d *duration) UnmarshalText(text []byte) error {
 	var err error
+	if len(text) == 0 {
+		d.Duration = 0
+		return nil
+	}
 	d.Duration, err = time.ParseDuration(string(text))
 	return err
 }
+
+func (d duration) MarshalText() ([]byte, error) {
+	if d.Duration == 0 {
+		return []byte{}, nil
+	}
+	return []byte(d.Duration.String()), nil
+}
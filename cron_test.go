@@ -0,0 +1,135 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Tuesday
+	from := time.Date(2016, 1, 12, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expression string
+		next       time.Time
+	}{
+		{"*/15 * * * *", time.Date(2016, 1, 12, 10, 15, 0, 0, time.UTC)},
+		{"7 10 * * *", time.Date(2016, 1, 13, 10, 7, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2016, 1, 12, 10, 25, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2016, 1, 13, 9, 30, 0, 0, time.UTC)},
+		{"0 9,17 * * *", time.Date(2016, 1, 12, 17, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * 3 *", time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)},
+		// Sunday is 0 or 7
+		{"0 0 * * 0", time.Date(2016, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2016, 1, 17, 0, 0, 0, 0, time.UTC)},
+		// Either day matching will do when both are restricted, the 20th or a Friday
+		{"0 0 20 * 5", time.Date(2016, 1, 15, 0, 0, 0, 0, time.UTC)},
+		// Both have to match when one isn't restricted
+		{"0 0 20 * *", time.Date(2016, 1, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Never happens
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		cron, err := parseCron(test.expression)
+		if err != nil {
+			t.Errorf("%s: %s", test.expression, err)
+			continue
+		}
+		if next := cron.next(from); !next.Equal(test.next) {
+			t.Errorf("%s: expected %s, got %s", test.expression, test.next, next)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expression := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"10-5 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(expression); err == nil {
+			t.Errorf("%s: expected an error", expression)
+		}
+	}
+}
+
+func TestScheduleTimeZone(t *testing.T) {
+	melbourne, err := time.LoadLocation("Australia/Melbourne")
+	if err != nil {
+		t.Skip("No time zone database:", err)
+	}
+	schedule := []*scheduleWindow{
+		{Cron: "0 9 * * *", TimeZone: "Australia/Melbourne", Duration: duration{time.Hour}},
+		{Cron: "0 9 * * *", Duration: duration{time.Hour}},
+	}
+	if err = compileSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	if schedule[0].location.String() != melbourne.String() {
+		t.Errorf("Expected Australia/Melbourne, got %s", schedule[0].location)
+	}
+	if schedule[1].location != time.Local {
+		t.Errorf("Expected the local time zone without a TimeZone, got %s", schedule[1].location)
+	}
+
+	tests := []struct {
+		name  string
+		t     time.Time
+		start time.Time
+	}{
+		// 9am in summer is 10pm UTC the day before, today's has been and gone
+		{"summer", time.Date(2016, 1, 12, 0, 0, 0, 0, time.UTC), time.Date(2016, 1, 12, 22, 0, 0, 0, time.UTC)},
+		// and 11pm UTC in winter
+		{"winter", time.Date(2016, 7, 12, 0, 0, 0, 0, time.UTC), time.Date(2016, 7, 12, 23, 0, 0, 0, time.UTC)},
+		// Half way through a window it's still going
+		{"started", time.Date(2016, 1, 12, 22, 30, 0, 0, time.UTC), time.Date(2016, 1, 12, 22, 0, 0, 0, time.UTC)},
+		// The clocks went back an hour overnight on the 3rd of April 2016, so 9am went from
+		// 10pm to 11pm UTC
+		{"daylight saving ends", time.Date(2016, 4, 2, 12, 0, 0, 0, time.UTC), time.Date(2016, 4, 2, 23, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		window, ok := schedule[0].next(test.t)
+		if !ok {
+			t.Errorf("%s: expected a window", test.name)
+			continue
+		}
+		if !window.Start.Equal(test.start) || !window.End.Equal(test.start.Add(time.Hour)) {
+			t.Errorf("%s: expected %s, got %s to %s", test.name, test.start, window.Start, window.End)
+		}
+		if window.Start.Location().String() != "Australia/Melbourne" {
+			t.Errorf("%s: expected the window in Australia/Melbourne, got %s", test.name, window.Start.Location())
+		}
+	}
+
+	if err = compileSchedule([]*scheduleWindow{{Cron: "0 9 * * *", TimeZone: "Nowhere/Special", Duration: duration{time.Hour}}}); err == nil {
+		t.Error("Expected an unknown time zone to be refused")
+	}
+}
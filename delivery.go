@@ -0,0 +1,135 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Requests bigger than this can't be copied to several targets, we'd have to hold them in memory
+const copyMaxBody = 10 << 20
+
+const deliveryTimeout = 30 * time.Second
+
+// Headers that only mean something for the connection they arrived on
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type deliveryResult struct {
+	Target   string
+	Response capturedResponse
+}
+
+// readCopyableBody reads the request body so it can be sent more than once, if it's too big to
+// copy r.Body is put back together and false is returned
+func readCopyableBody(r *http.Request) ([]byte, bool, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, copyMaxBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > copyMaxBody {
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		return body, false, nil
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+// copyRequest makes a fresh request to target out of r, it has to happen before r is directed anywhere
+func copyRequest(ip string, data *proxyData, target *URL, r *http.Request, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(r.Method, r.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+	req.TLS = r.TLS
+	req = withRequestID(req, requestID(r))
+	directRequest(ip, data, target.URL, req)
+	return req, nil
+}
+
+// deliver sends req and records the response, if w isn't nil the response is also passed on to it
+func deliver(ip string, target string, req *http.Request, w http.ResponseWriter) *deliveryResult {
+	client := &http.Client{
+		Transport: proxyTransport(ip),
+		Timeout:   deliveryTimeout,
+		// The primary doesn't follow redirects, neither should the copies
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	result := &deliveryResult{Target: target}
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("[%s] delivery to %s failed: %s", ip, target, err)
+		result.Response = capturedResponse{Error: err.Error(), Duration: duration{time.Since(start)}}
+		if w != nil {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}
+		return result
+	}
+	defer res.Body.Close()
+	wait := time.Since(start)
+
+	if w != nil {
+		for _, name := range hopHeaders {
+			res.Header.Del(name)
+		}
+		for name, val := range res.Header {
+			w.Header()[name] = val
+		}
+		capture := newCaptureWriter(w)
+		capture.WriteHeader(res.StatusCode)
+		_, err = io.Copy(capture, res.Body)
+		result.Response = capture.response(start)
+	} else {
+		var body []byte
+		body, err = ioutil.ReadAll(io.LimitReader(res.Body, int64(config().Traffic.BodyLimit)+1))
+		result.Response = capturedResponse{
+			Status:   res.StatusCode,
+			Header:   res.Header,
+			Wait:     duration{wait},
+			Duration: duration{time.Since(start)},
+		}
+		result.Response.Body, result.Response.BodyTruncated = truncateBody(body)
+	}
+	if err != nil {
+		result.Response.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,155 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Headers that differ between any two responses and would only be noise
+var diffIgnoreHeaders = map[string]bool{
+	"Date":           true,
+	"Content-Length": true,
+}
+
+// Past this many lines the line by line body diff gets too expensive, we just say they differ
+const diffMaxLines = 2000
+
+type headerDiff struct {
+	Name    string
+	Primary []string
+	Shadow  []string
+}
+
+type responseDiff struct {
+	Target        string
+	Error         string `json:",omitempty"`
+	StatusDiffers bool
+	PrimaryStatus int
+	ShadowStatus  int
+	Headers       []headerDiff
+	BodyDiffers   bool
+	// Lines prefixed with "-" are only in the primary, "+" only in the shadow, " " in both
+	Body []string `json:",omitempty"`
+}
+
+func diffRecord(record *trafficRecord) []*responseDiff {
+	diffs := make([]*responseDiff, 0, len(record.Shadows))
+	for _, shadow := range record.Shadows {
+		if shadow == nil {
+			continue
+		}
+		diffs = append(diffs, diffResponses(shadow.Target, record.Response, shadow.Response))
+	}
+	return diffs
+}
+
+func diffResponses(target string, primary, shadow capturedResponse) *responseDiff {
+	diff := &responseDiff{
+		Target:        target,
+		Error:         shadow.Error,
+		StatusDiffers: primary.Status != shadow.Status,
+		PrimaryStatus: primary.Status,
+		ShadowStatus:  shadow.Status,
+		Headers:       diffHeaders(primary.Header, shadow.Header),
+		BodyDiffers:   primary.Body != shadow.Body,
+	}
+	if diff.BodyDiffers {
+		diff.Body = diffLines(strings.Split(primary.Body, "\n"), strings.Split(shadow.Body, "\n"))
+	}
+	return diff
+}
+
+func diffHeaders(primary, shadow http.Header) []headerDiff {
+	names := map[string]bool{}
+	for name := range primary {
+		names[name] = true
+	}
+	for name := range shadow {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !diffIgnoreHeaders[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	diffs := []headerDiff{}
+	for _, name := range sorted {
+		p, s := primary[name], shadow[name]
+		if strings.Join(p, "\n") != strings.Join(s, "\n") {
+			diffs = append(diffs, headerDiff{Name: name, Primary: p, Shadow: s})
+		}
+	}
+	return diffs
+}
+
+// diffLines is a plain longest common subsequence diff, good enough for eyeballing responses
+func diffLines(a, b []string) []string {
+	if len(a) > diffMaxLines || len(b) > diffMaxLines {
+		return nil
+	}
+
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+"+b[j])
+	}
+	return lines
+}
@@ -0,0 +1,173 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"log"
+	"net"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+type discoveryConfiguration struct {
+	// Interface name patterns, eth1 or eth* say, empty means any
+	Interfaces []string `toml:"interfaces"`
+	// Networks addresses have to be in, empty means any
+	Networks []string `toml:"networks"`
+	Interval duration `toml:"interval"`
+}
+
+func (d discoveryConfiguration) enabled() bool {
+	return len(d.Interfaces) > 0 || len(d.Networks) > 0
+}
+
+// discoverAddresses finds every address on the host that matches
+func discoverAddresses(d discoveryConfiguration) (ipAddressesConfiguration, error) {
+	networks := make([]*net.IPNet, 0, len(d.Networks))
+	for _, cidr := range d.Networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	discovered := ipAddressesConfiguration{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || !matchesInterface(d.Interfaces, iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			// Link local addresses need a zone to be listened on, they're not much use to anybody outside anyway
+			if !ok || ipnet.IP.IsLinkLocalUnicast() || !inNetworks(networks, ipnet.IP) {
+				continue
+			}
+			discovered[ipnet.IP.String()] = ipAddressConfiguration{
+				Description: "Discovered on " + iface.Name,
+				Discovered:  true,
+				Interface:   iface.Name,
+			}
+		}
+	}
+	return discovered, nil
+}
+
+func matchesInterface(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func inNetworks(networks []*net.IPNet, ip net.IP) bool {
+	if len(networks) == 0 {
+		return true
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncDiscovered binds addresses that have turned up and removes ones that have gone away,
+// addresses from the configuration always win and ones an admin removed stay removed.
+// It's up to the caller to serve what was bound
+func syncDiscovered() ([]*proxyInterface, error) {
+	c := config()
+	discovered := ipAddressesConfiguration{}
+	if c.Discovery.enabled() {
+		var err error
+		if discovered, err = discoverAddresses(c.Discovery); err != nil {
+			return nil, err
+		}
+	}
+	removed, err := removedAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var bound []*proxyInterface
+	running := manager.addresses()
+	for ip, address := range discovered {
+		if _, ok := running[ip]; ok || removed[ip] {
+			continue
+		}
+		if _, ok := c.Addresses[ip]; ok {
+			continue
+		}
+		log.Printf("[%s] discovered on %s", ip, address.Interface)
+		iface, err := manager.bind(ip, address)
+		if err != nil {
+			log.Printf("[%s] Unable to bind discovered address: %s", ip, err)
+			continue
+		}
+		bound = append(bound, iface)
+	}
+	for ip, address := range running {
+		if _, ok := discovered[ip]; ok || !address.Discovered {
+			continue
+		}
+		log.Printf("[%s] gone from %s", ip, address.Interface)
+		manager.remove(ip)
+	}
+	return bound, nil
+}
+
+// discoverer keeps the discovered addresses in sync with the host
+func discoverer() {
+	for {
+		interval := config().Discovery.Interval.Duration
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		time.Sleep(interval)
+		if atomic.LoadInt32(&handedOff) == 1 {
+			return
+		}
+
+		bound, err := syncDiscovered()
+		if err != nil {
+			log.Println("Unable to discover addresses:", err)
+			continue
+		}
+		for _, iface := range bound {
+			iface.serve()
+		}
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// interfaceActivity is what's going on with an interface right now, it isn't saved with the state
+type interfaceActivity struct {
+	Connections int64
+	Requests    int
+	LastRequest time.Time
+	// Left of the request budget, if there is one
+	BudgetRemaining *int64 `json:",omitempty"`
+	Draining        bool
+	DrainDeadline   time.Time
+}
+
+// proxyView is how a proxy is shown through the API, its data along with its activity and health
+type proxyView struct {
+	*proxyData
+	Activity interfaceActivity
+	Health   *healthStatus
+	Upcoming []scheduledWindow
+}
+
+// inFlight tracks the requests an interface is handling so they can be waited on and, once
+// the drain timeout is up, cut off
+type inFlight struct {
+	sync.Mutex
+	nextID   int64
+	requests map[int64]context.CancelFunc
+	// Signalled every time a request finishes
+	finished chan struct{}
+
+	drainDeadline time.Time
+	// Closed to call a drain off, when the interface is enabled again mid drain
+	drainStop chan struct{}
+}
+
+func (i *proxyInterface) view() *proxyView {
+	data := i.data()
+	// A shallow copy is enough, it's only for leaving the owner's address out
+	shown := *data
+	shown.WhoMail = ""
+	return &proxyView{
+		proxyData: &shown,
+		Activity:  i.activity(),
+		Health:    i.healthStatus(),
+		Upcoming:  upcoming(data.Schedule, time.Now(), 5),
+	}
+}
+
+func (i *proxyInterface) activity() interfaceActivity {
+	i.inFlight.Lock()
+	defer i.inFlight.Unlock()
+	return interfaceActivity{
+		Connections:     atomic.LoadInt64(&i.connections),
+		Requests:        len(i.inFlight.requests),
+		LastRequest:     i.lastRequestTime(),
+		BudgetRemaining: i.budgetRemaining(),
+		Draining:        i.inFlight.drainStop != nil,
+		DrainDeadline:   i.inFlight.drainDeadline,
+	}
+}
+
+// trackConnections is the http.Server ConnState hook
+func (i *proxyInterface) trackConnections(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&i.connections, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&i.connections, -1)
+	}
+}
+
+// track wraps a handler so its requests can be drained
+func (i *proxyInterface) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt64(&i.lastRequest, time.Now().UnixNano())
+		ctx, cancel := context.WithCancel(r.Context())
+		i.inFlight.Lock()
+		i.inFlight.nextID++
+		id := i.inFlight.nextID
+		i.inFlight.requests[id] = cancel
+		i.inFlight.Unlock()
+
+		defer func() {
+			cancel()
+			i.inFlight.Lock()
+			delete(i.inFlight.requests, id)
+			i.inFlight.Unlock()
+			select {
+			case i.inFlight.finished <- struct{}{}:
+			default:
+			}
+		}()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// drain gives whatever is in flight until the drain timeout to finish before cutting it off,
+// new requests are already going to the disabled handler by the time this is called
+func (i *proxyInterface) drain() {
+	i.inFlight.Lock()
+	defer i.inFlight.Unlock()
+	if len(i.inFlight.requests) == 0 || i.inFlight.drainStop != nil {
+		return
+	}
+
+	timeout := config().DrainTimeout.Duration
+	stop := make(chan struct{})
+	i.inFlight.drainStop = stop
+	i.inFlight.drainDeadline = time.Now().Add(timeout)
+	log.Printf("[%s] draining %d requests", i.ip, len(i.inFlight.requests))
+
+	go func() {
+		deadline := time.After(timeout)
+		for {
+			select {
+			case <-i.inFlight.finished:
+				if i.activity().Requests > 0 {
+					continue
+				}
+				log.Printf("[%s] drained", i.ip)
+			case <-deadline:
+				log.Printf("[%s] drain timed out, cutting off %d requests", i.ip, i.cutOff())
+			case <-stop:
+				return
+			}
+			i.stopDrain(stop)
+			return
+		}
+	}()
+}
+
+// cutOff cancels everything in flight, returning how many that was
+func (i *proxyInterface) cutOff() int {
+	i.inFlight.Lock()
+	defer i.inFlight.Unlock()
+	for _, cancel := range i.inFlight.requests {
+		cancel()
+	}
+	return len(i.inFlight.requests)
+}
+
+// stopDrain calls off the drain if it's still the one going
+func (i *proxyInterface) stopDrain(stop chan struct{}) {
+	i.inFlight.Lock()
+	defer i.inFlight.Unlock()
+	if stop == nil {
+		stop = i.inFlight.drainStop
+	}
+	if stop != nil && i.inFlight.drainStop == stop {
+		close(stop)
+		i.inFlight.drainStop = nil
+		i.inFlight.drainDeadline = time.Time{}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const modeFanOut = "fanout"
+
+type fanOutData struct {
+	Subscribers []*URL
+	// The subscriber whose response goes back to the caller, empty answers with a plain 200
+	Primary string
+}
+
+func (f *fanOutData) validate() error {
+	primaryFound := f.Primary == ""
+	for _, subscriber := range f.Subscribers {
+		if subscriber == nil || subscriber.URL == nil || subscriber.Scheme == "" || subscriber.Host == "" {
+			return errors.New("Subscribers must be absolute URLs")
+		}
+		primaryFound = primaryFound || subscriber.String() == f.Primary
+	}
+	if !primaryFound {
+		return errors.New("Primary must be one of the subscribers")
+	}
+	return nil
+}
+
+// serveFanOut delivers the request to every subscriber at once, the caller gets the primary
+// subscriber's response or a plain 200 without waiting on anyone
+func serveFanOut(ip string, data *proxyData, w http.ResponseWriter, r *http.Request) {
+	body, ok, err := readCopyableBody(r)
+	if err != nil {
+		http.Error(w, "Unable to read request", http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		log.Printf("[%s] %s %s %s too large to fan out", ip, clientIP(r), r.Host, r.URL.String())
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	start := time.Now()
+	fanOut := data.FanOut
+	record := &trafficRecord{
+		Started:    start,
+		ClientIP:   clientIP(r),
+		Request:    captureRequest(r, body),
+		Deliveries: make([]*deliveryResult, len(fanOut.Subscribers)),
+	}
+
+	var wg sync.WaitGroup
+	primary, primaryIndex := (*http.Request)(nil), -1
+	for i, subscriber := range fanOut.Subscribers {
+		req, err := copyRequest(ip, data, subscriber, r, body)
+		if err != nil {
+			record.Deliveries[i] = &deliveryResult{Target: subscriber.String(), Response: capturedResponse{Error: err.Error()}}
+			continue
+		}
+		if primary == nil && subscriber.String() == fanOut.Primary {
+			primary, primaryIndex = req, i
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, target string, req *http.Request) {
+			defer wg.Done()
+			record.Deliveries[i] = deliver(ip, target, req, nil)
+		}(i, subscriber.String(), req)
+	}
+
+	if primary != nil {
+		// The primary's response goes straight back to the caller
+		record.Deliveries[primaryIndex] = deliver(ip, fanOut.Primary, primary, w)
+		record.Response = record.Deliveries[primaryIndex].Response
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Delivered"))
+		record.Response = capturedResponse{
+			Status:   http.StatusOK,
+			Header:   w.Header().Clone(),
+			Body:     "Delivered",
+			Duration: duration{time.Since(start)},
+		}
+	}
+	log.Printf("[%s] %s %s %s fanned out to %d subscribers", ip, record.ClientIP, r.Host, r.URL.String(), len(fanOut.Subscribers))
+
+	go func() {
+		wg.Wait()
+		getTrafficLog(ip).add(record)
+	}()
+}
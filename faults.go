@@ -0,0 +1,154 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+type faultRule struct {
+	requestMatcher
+	Enabled bool
+	// Delay the request by Latency plus a random amount up to Jitter
+	Latency duration
+	Jitter  duration
+	// Percentage (0-100) of requests answered with ErrorStatus instead of being handled
+	ErrorPercent float64
+	ErrorStatus  int
+	// Percentage (0-100) of requests that have their connection reset
+	ResetPercent float64
+	// Limit the response to this many bytes per second, 0 for unlimited
+	Bandwidth int
+}
+
+func compileFaults(faults []*faultRule) error {
+	for _, f := range faults {
+		if err := f.compile(); err != nil {
+			return err
+		}
+		if f.ErrorPercent < 0 || f.ErrorPercent > 100 || f.ResetPercent < 0 || f.ResetPercent > 100 {
+			return errors.New("Fault percentages must be between 0 and 100")
+		}
+		if f.ErrorStatus != 0 && (f.ErrorStatus < 100 || f.ErrorStatus > 999) {
+			return errors.New("Fault error status must be a valid HTTP status code")
+		}
+		if f.Bandwidth < 0 {
+			return errors.New("Fault bandwidth can't be negative")
+		}
+	}
+	return nil
+}
+
+// applyFaults runs the first enabled rule matching the request, it returns false if the request
+// has been dealt with and shouldn't go any further, otherwise the writer to carry on with
+func applyFaults(ip string, faults []*faultRule, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, bool) {
+	for _, f := range faults {
+		if !f.Enabled || f.match(r) == nil {
+			continue
+		}
+
+		delay := f.Latency.Duration
+		if f.Jitter.Duration > 0 {
+			delay += time.Duration(rand.Int63n(int64(f.Jitter.Duration)))
+		}
+		if delay > 0 {
+			// Gone, or cut off by a drain, there's nobody left to be slow for
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return w, false
+			}
+		}
+
+		clientIP := clientIP(r)
+		if f.ResetPercent > 0 && rand.Float64()*100 < f.ResetPercent {
+			log.Printf("[%s] %s %s %s fault: connection reset", ip, clientIP, r.Host, r.URL.String())
+			resetConnection(w)
+			return w, false
+		}
+
+		if f.ErrorPercent > 0 && rand.Float64()*100 < f.ErrorPercent {
+			status := f.ErrorStatus
+			if status == 0 {
+				status = http.StatusServiceUnavailable
+			}
+			log.Printf("[%s] %s %s %s fault: error %d", ip, clientIP, r.Host, r.URL.String(), status)
+			http.Error(w, http.StatusText(status), status)
+			return w, false
+		}
+
+		if f.Bandwidth > 0 {
+			w = &throttledWriter{wrappedWriter: wrappedWriter{w}, bandwidth: f.Bandwidth}
+		}
+		return w, true
+	}
+	return w, true
+}
+
+// resetConnection drops the connection with a RST where it can, http2 only gets its stream reset
+func resetConnection(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				conn = tlsConn.NetConn()
+			}
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				tcpConn.SetLinger(0)
+			}
+			conn.Close()
+			return
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// Write in small slices so the throttling is smooth rather than bursty
+const throttleChunk = 1024
+
+type throttledWriter struct {
+	wrappedWriter
+	bandwidth int
+}
+
+func (t *throttledWriter) Write(b []byte) (written int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		start := time.Now()
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		t.Flush()
+		b = b[n:]
+		time.Sleep(time.Duration(n)*time.Second/time.Duration(t.bandwidth) - time.Since(start))
+	}
+	return
+}
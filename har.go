@@ -0,0 +1,271 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HTTP Archive 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	Comment     string         `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+const harTruncatedComment = "Body truncated by zookeeper"
+
+// trafficFilter narrows down which records get listed or exported, the zero value matches everything
+type trafficFilter struct {
+	From   time.Time
+	To     time.Time
+	Method string
+	Path   *regexp.Regexp
+	Status int
+}
+
+func (f *trafficFilter) match(record *trafficRecord) bool {
+	if !f.From.IsZero() && record.Started.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && record.Started.After(f.To) {
+		return false
+	}
+	if f.Method != "" && !strings.EqualFold(f.Method, record.Request.Method) {
+		return false
+	}
+	if f.Status != 0 && f.Status != record.Response.Status {
+		return false
+	}
+	if f.Path != nil {
+		u, err := url.Parse(record.Request.URL)
+		if err != nil || !f.Path.MatchString(u.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+func filterTraffic(records []*trafficRecord, filter *trafficFilter) []*trafficRecord {
+	filtered := []*trafficRecord{}
+	for _, record := range records {
+		if filter.match(record) {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+func milliseconds(d duration) float64 {
+	return float64(d.Duration) / float64(time.Millisecond)
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	pairs := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	pairs := []harNameValue{}
+	for _, cookie := range cookies {
+		pairs = append(pairs, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return pairs
+}
+
+func harMimeType(header http.Header) string {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+// harText returns the body as text, falling back to base64 for anything that isn't utf-8
+func harText(body string) (text, encoding string) {
+	if utf8.ValidString(body) {
+		return body, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(body)), "base64"
+}
+
+func harFromRecord(record *trafficRecord) harEntry {
+	req, res := record.Request, record.Response
+
+	request := harRequest{
+		Method:      req.Method,
+		URL:         req.URL,
+		HTTPVersion: req.Proto,
+		Cookies:     harCookies((&http.Request{Header: req.Header}).Cookies()),
+		Headers:     harHeaders(req.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(req.Body),
+	}
+	if u, err := url.Parse(req.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				request.QueryString = append(request.QueryString, harNameValue{Name: name, Value: value})
+			}
+		}
+	}
+	if req.Body != "" {
+		// postData can't be base64 encoded in HAR 1.2, invalid utf-8 gets mangled by the JSON encoder
+		request.PostData = &harPostData{MimeType: harMimeType(req.Header), Text: req.Body}
+		if req.BodyTruncated {
+			request.PostData.Comment = harTruncatedComment
+		}
+	}
+
+	response := harResponse{
+		Status:      res.Status,
+		StatusText:  http.StatusText(res.Status),
+		HTTPVersion: req.Proto,
+		Cookies:     harCookies((&http.Response{Header: res.Header}).Cookies()),
+		Headers:     harHeaders(res.Header),
+		Content: harContent{
+			Size:     len(res.Body),
+			MimeType: harMimeType(res.Header),
+		},
+		RedirectURL: res.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(res.Body),
+		Comment:     res.Error,
+	}
+	response.Content.Text, response.Content.Encoding = harText(res.Body)
+	if res.BodyTruncated {
+		response.Content.Comment = harTruncatedComment
+	}
+	if mediaType, _, err := mime.ParseMediaType(response.Content.MimeType); err == nil {
+		response.Content.MimeType = mediaType
+	}
+
+	wait := milliseconds(res.Wait)
+	total := milliseconds(res.Duration)
+	return harEntry{
+		StartedDateTime: record.Started,
+		Time:            total,
+		Request:         request,
+		Response:        response,
+		Timings: harTimings{
+			Send:    0,
+			Wait:    wait,
+			Receive: total - wait,
+		},
+		Comment: "Client " + record.ClientIP,
+	}
+}
+
+func buildHAR(records []*trafficRecord) *har {
+	archive := &har{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "zookeeper", Version: "1.0"},
+			Entries: make([]harEntry, 0, len(records)),
+		},
+	}
+	for _, record := range records {
+		archive.Log.Entries = append(archive.Log.Entries, harFromRecord(record))
+	}
+	return archive
+}
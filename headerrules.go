@@ -0,0 +1,150 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"text/template"
+	"time"
+)
+
+type contextKey string
+
+const requestIDKey contextKey = "requestID"
+
+type headerRule struct {
+	requestMatcher
+	// Request headers that have to match these regular expressions for the rule to apply
+	When map[string]string
+	// The header to set, Value is a text/template with headerVariables available
+	Name  string
+	Value string
+	// Add to any existing values rather than replacing them
+	Append bool
+	// Remove the header instead of setting it
+	Remove bool
+
+	whenRegexps   map[string]*regexp.Regexp
+	valueTemplate *template.Template
+}
+
+// headerVariables are what header rule templates have to work with
+type headerVariables struct {
+	ClientIP     string
+	RequestID    string
+	SNI          string
+	Method       string
+	OriginalHost string
+	OriginalPath string
+	Query        string
+	Interface    string
+	Owner        string
+	Time         time.Time
+	Header       http.Header
+}
+
+func compileHeaderRules(rules []*headerRule) (err error) {
+	for i, rule := range rules {
+		if rule == nil || rule.Name == "" {
+			return fmt.Errorf("Header rule %d needs a Name", i+1)
+		}
+		if err = rule.compile(); err != nil {
+			return
+		}
+		rule.whenRegexps = map[string]*regexp.Regexp{}
+		for name, expression := range rule.When {
+			if rule.whenRegexps[textproto.CanonicalMIMEHeaderKey(name)], err = regexp.Compile(expression); err != nil {
+				return fmt.Errorf("Unable to compile header condition %s %q: %s", name, expression, err)
+			}
+		}
+		if rule.valueTemplate, err = template.New(rule.Name).Parse(rule.Value); err != nil {
+			return fmt.Errorf("Unable to compile header template for %s: %s", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func (h *headerRule) applies(r *http.Request) bool {
+	if h.match(r) == nil {
+		return false
+	}
+	for name, expression := range h.whenRegexps {
+		if !expression.MatchString(r.Header.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyHeaderRules has to see the request before it's been pointed at the target, vars carry
+// what it looked like when it arrived
+func applyHeaderRules(ip string, rules []*headerRule, vars headerVariables, r *http.Request) {
+	for _, rule := range rules {
+		if rule.valueTemplate == nil || !rule.applies(r) {
+			continue
+		}
+		if rule.Remove {
+			r.Header.Del(rule.Name)
+			continue
+		}
+
+		var value bytes.Buffer
+		if err := rule.valueTemplate.Execute(&value, vars); err != nil {
+			log.Printf("[%s] Unable to execute header template for %s: %s", ip, rule.Name, err)
+			continue
+		}
+		if rule.Append {
+			r.Header.Add(rule.Name, value.String())
+		} else {
+			r.Header.Set(rule.Name, value.String())
+		}
+	}
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// withRequestID tags the request with an id that sticks to it and any copies made of it
+func withRequestID(r *http.Request, id string) *http.Request {
+	if id == "" {
+		id = r.Header.Get("X-Request-Id")
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
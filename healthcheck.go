@@ -0,0 +1,160 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type healthCheckConfiguration struct {
+	Interval duration `toml:"interval"`
+	Timeout  duration `toml:"timeout"`
+}
+
+type healthStatus struct {
+	Checked     time.Time
+	Healthy     bool
+	LastSuccess time.Time
+	LastError   string
+	// How long the whole check took, connect, handshake and probe
+	Latency duration
+}
+
+func targetAddress(target *url.URL) string {
+	if _, _, err := net.SplitHostPort(target.Host); err == nil {
+		return target.Host
+	}
+	if target.Scheme == "https" {
+		return net.JoinHostPort(target.Host, "443")
+	}
+	return net.JoinHostPort(target.Host, "80")
+}
+
+// checkTarget connects to the target the same way the proxy would, then asks for the probe path
+// if there is one
+func checkTarget(ip string, data *proxyData) error {
+	target := data.TargetURL.URL
+	if target == nil || target.Host == "" {
+		return errors.New("No target URL")
+	}
+	timeout := config().HealthCheck.Timeout.Duration
+
+	conn, err := net.DialTimeout("tcp", targetAddress(target), timeout)
+	if err != nil {
+		return fmt.Errorf("Connect failed: %s", err)
+	}
+	defer conn.Close()
+
+	if target.Scheme == "https" {
+		tlsConfig := &tls.Config{ServerName: target.Hostname()}
+		if data.Protocol == protocolHTTP2 {
+			tlsConfig.NextProtos = []string{protocolHTTP2}
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err = tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake failed: %s", err)
+		}
+	}
+
+	if data.ProbePath == "" {
+		return nil
+	}
+
+	probe := *target
+	probe.Path = singleJoiningSlash(target.Path, data.ProbePath)
+	probe.RawQuery = ""
+	client := &http.Client{Transport: proxyTransport(ip), Timeout: timeout}
+	res, err := client.Get(probe.String())
+	if err != nil {
+		return fmt.Errorf("Probe failed: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("Probe answered %d", res.StatusCode)
+	}
+	return nil
+}
+
+// healthStatus is the result of the last check, nil if there hasn't been one
+func (i *proxyInterface) healthStatus() *healthStatus {
+	status, _ := i.health.Load().(*healthStatus)
+	return status
+}
+
+// runHealthCheck checks the target and records the result against the interface
+func runHealthCheck(ip string) *healthStatus {
+	iface := manager.get(ip)
+	if iface == nil {
+		return nil
+	}
+	data := iface.data()
+	start := time.Now()
+	err := checkTarget(ip, data)
+
+	status := &healthStatus{
+		Checked: time.Now(),
+		Healthy: err == nil,
+		Latency: duration{time.Since(start)},
+	}
+	previous := iface.healthStatus()
+	if previous != nil {
+		status.LastSuccess = previous.LastSuccess
+		status.LastError = previous.LastError
+	}
+	if err == nil {
+		status.LastSuccess = status.Checked
+	} else {
+		status.LastError = err.Error()
+		if previous == nil || previous.Healthy {
+			log.Printf("[%s] target %s unhealthy: %s", ip, data.TargetURL, err)
+		}
+	}
+	iface.health.Store(status)
+	return status
+}
+
+// healthChecker keeps checking the target until stop is closed
+func healthChecker(ip string, stop chan bool) {
+	if config().HealthCheck.Interval.Duration <= 0 {
+		return
+	}
+	ticker := time.NewTicker(config().HealthCheck.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Nothing to check when mocking or fanning out
+			if data := getData(ip); data.Mode == "" || data.Mode == modeProxy {
+				runHealthCheck(ip)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// lastRequestTime is when the proxy was last called while it was up, zero if it hasn't been
+func (i *proxyInterface) lastRequestTime() time.Time {
+	if last := atomic.LoadInt64(&i.lastRequest); last != 0 {
+		return time.Unix(0, last)
+	}
+	return time.Time{}
+}
+
+// idleWatcher disables the proxy once nothing has come in for its IdleTimeout, counting from
+// since if nothing has come in at all. Requests still being handled count as something
+func (i *proxyInterface) idleWatcher(stop chan bool, since time.Time) {
+	for {
+		wait := time.Minute
+		if timeout := i.data().IdleTimeout.Duration; timeout > 0 {
+			last := i.lastRequestTime()
+			if last.Before(since) {
+				last = since
+			}
+			idle := time.Since(last)
+			switch {
+			case i.activity().Requests > 0:
+				wait = timeout
+			case idle >= timeout:
+				log.Printf("[%s] Nothing for %s, shutting down", i.ip, idle.Truncate(time.Second))
+				i.disableIf(stop, fmt.Sprintf("Idle for %s", timeout))
+				return
+			default:
+				wait = timeout - idle
+			}
+		}
+		// Checked every so often in case the timeout is changed while it's up
+		if wait > time.Minute {
+			wait = time.Minute
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+	}
+}
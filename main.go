@@ -24,6 +24,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -31,10 +32,12 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo"
 	"github.com/tylerb/graceful"
+	"golang.org/x/net/http2"
 )
 
 type URL struct {
@@ -58,6 +61,13 @@ func (u *URL) UnmarshalJSON(b []byte) error {
 	return err
 }
 
+// Exit codes, they're combined when more than one thing went wrong
+const (
+	exitAdminFailed    = 1
+	exitRequestsCutOff = 2
+	exitStateNotSaved  = 4
+)
+
 type EchoMiddlewareUser interface {
 	Use(m ...echo.Middleware)
 }
@@ -68,31 +78,48 @@ type EchoStasher interface {
 }
 
 type proxyData struct {
+	proxySettings
+	Enabled bool
+	Who     string
+	// Where Who gets email, looked up when they enabled it. It's saved and replicated but never
+	// shown, see view
+	WhoMail string `json:",omitempty"`
+	Expire  time.Time
+	// Why and when it was last disabled
+	DisableReason string
+	Disabled      time.Time
+}
+
+// proxySettings is the part of proxyData that can be changed through the admin interface, the
+// rest is looked after by zookeeper itself and only changes by enabling and disabling
+type proxySettings struct {
 	TargetURL    *URL
 	SetHeader    http.Header
-	Enabled      bool
 	Comment      string
-	Who          string
 	MaintainHost bool
-	Expire       time.Time
-	stop         chan bool
+	Protocol     string
+	Streaming    streamingData
+	Mode         string
+	Mocks        []*mockResponse
+	Faults       []*faultRule
+	Shadows      []*URL
+	FanOut       fanOutData
+	Record       bool
+	Queue        bool
+	ProbePath    string
+	Rewrites     []*rewriteRule
+	HeaderRules  []*headerRule
+	Schedule     []*scheduleWindow
+	IdleTimeout  duration
+	Budget       *requestBudget
 }
 
-var config *configuration
-
-var proxies = map[string]*http.Server{}
-var metaData = map[string]*proxyData{}
-
+// getData returns the current snapshot for ip, it must not be modified - see proxyInterface.update
 func getData(ip string) *proxyData {
-	data, ok := metaData[ip]
-	if !ok {
-		data = &proxyData{
-			TargetURL: &URL{},
-			SetHeader: make(http.Header),
-		}
-		metaData[ip] = data
+	if iface := manager.get(ip); iface != nil {
+		return iface.data()
 	}
-	return data
+	return newProxyData()
 }
 
 func clientIP(r *http.Request) string {
@@ -106,16 +133,14 @@ func clientIP(r *http.Request) string {
 }
 
 func proxyDownInterface(ip string) (e *echo.Echo) {
-	data := getData(ip)
-	data.Enabled = false
-	if data.stop != nil {
-		close(data.stop)
-	}
-	data.stop = nil
-
 	e = echo.New()
 	e.Any("/*", func(c *echo.Context) error {
 		r := c.Request()
+		if q := getQueue(ip); q != nil && getData(ip).Queue {
+			queueRequest(ip, q, c.Response(), r, nil)
+			return nil
+		}
+
 		clientIP := clientIP(r)
 		log.Printf("[%s] %s %s %s disabled", ip, clientIP, r.Host, r.URL.String())
 
@@ -136,76 +161,145 @@ func singleJoiningSlash(a, b string) string {
 	return a + b
 }
 
-func proxyUpInterface(ip string) *httputil.ReverseProxy {
-	data := getData(ip)
-	data.Enabled = true
-	if data.stop != nil {
-		close(data.stop)
-	}
-	data.stop = make(chan bool)
-	go func() {
-		select {
-		case <-time.After(data.Expire.Sub(time.Now())):
-			log.Println("Shutting down proxy interface on", ip)
-			proxies[ip].Handler = proxyDownInterface(ip)
-		case <-data.stop:
-			data.stop = nil
+func proxyUpInterface(ip string) http.Handler {
+	director := proxyDirector(ip)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := getData(ip)
+		r = withRequestID(r, "")
+		w, carryOn := applyFaults(ip, data.Faults, w, r)
+		if !carryOn {
+			return
+		}
+		switch data.Mode {
+		case modeMock:
+			serveRecorded(ip, data, w, r, func(w http.ResponseWriter, r *http.Request) {
+				serveMock(ip, data.Mocks, w, r)
+			})
+			return
+		case modeFanOut:
+			// Fan out and shadowing always record, there's more than one response to keep track of
+			serveFanOut(ip, data, w, r)
+			return
+		}
+		streaming := data.Streaming
+
+		// ReverseProxy is cheap to make, doing it per request means streaming changes apply immediately
+		proxy := &httputil.ReverseProxy{
+			Transport:     proxyTransport(ip),
+			Director:      director,
+			FlushInterval: streaming.FlushInterval.Duration,
 		}
-	}()
-
-	return &httputil.ReverseProxy{
-		Director: func(r *http.Request) {
-			data := getData(ip)
-			clientIP := clientIP(r)
-			originalRequest := r.URL
-			targetQuery := data.TargetURL.RawQuery
-
-			r.URL.Scheme = data.TargetURL.Scheme
-			r.URL.Host = data.TargetURL.Host
-			r.URL.Path = singleJoiningSlash(data.TargetURL.Path, r.URL.Path)
-			if targetQuery == "" || r.URL.RawQuery == "" {
-				r.URL.RawQuery = targetQuery + r.URL.RawQuery
-			} else {
-				r.URL.RawQuery = targetQuery + "&" + r.URL.RawQuery
+		if q := getQueue(ip); q != nil && data.Queue {
+			// Hang on to the body so the request can be queued if the target can't be reached
+			body, ok, err := readCopyableBody(r)
+			if err != nil {
+				http.Error(w, "Unable to read request", http.StatusBadRequest)
+				return
 			}
+			if ok {
+				queued := &http.Request{Method: r.Method, URL: &url.URL{}, Host: r.Host, Header: r.Header.Clone(), RemoteAddr: r.RemoteAddr}
+				*queued.URL = *r.URL
+				proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+					log.Printf("[%s] %s %s %s unable to reach target: %s", ip, clientIP(queued), queued.Host, queued.URL.String(), err)
+					queueRequest(ip, q, w, queued, body)
+				}
+			}
+		}
+		w = newStreamingWriter(w, streaming)
+		if len(data.Shadows) > 0 {
+			serveShadowed(ip, data, proxy, w, r)
+			return
+		}
+		serveRecorded(ip, data, w, r, proxy.ServeHTTP)
+	})
+}
 
-			log.Printf("[%s] %s %s %s > %s", ip, clientIP, r.Host, originalRequest.String(), r.URL.String())
+func proxyDirector(ip string) func(*http.Request) {
+	return func(r *http.Request) {
+		data := getData(ip)
+		directRequest(ip, data, data.TargetURL.URL, r)
+	}
+}
 
-			forwardedFor := r.Header.Get(echo.XForwardedFor)
-			if forwardedFor != "" {
-				forwardedFor += ", " + clientIP
-			} else {
-				forwardedFor = clientIP
-			}
+// directRequest points r at target, shadow requests go through here too
+func directRequest(ip string, data *proxyData, target *url.URL, r *http.Request) {
+	clientIP := clientIP(r)
+	originalRequest := r.URL
+	targetQuery := target.RawQuery
+
+	if len(data.HeaderRules) > 0 {
+		vars := headerVariables{
+			ClientIP:     clientIP,
+			RequestID:    requestID(r),
+			Method:       r.Method,
+			OriginalHost: r.Host,
+			OriginalPath: r.URL.Path,
+			Query:        r.URL.RawQuery,
+			Interface:    ip,
+			Owner:        data.Who,
+			Time:         time.Now(),
+			Header:       r.Header.Clone(),
+		}
+		if r.TLS != nil {
+			vars.SNI = r.TLS.ServerName
+		}
+		// Conditions are matched against the request as it arrived
+		applyHeaderRules(ip, data.HeaderRules, vars, r)
+	}
 
-			r.Header.Add("X-Remote-Addr", r.RemoteAddr)
-			r.Header.Add("X-Real-IP", clientIP)
-			r.Header.Add("X-Forwarded-For", forwardedFor)
+	rewriteURL(data.Rewrites, r.URL)
 
-			for name, val := range data.SetHeader {
-				r.Header[name] = val
-			}
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	r.URL.Path = singleJoiningSlash(target.Path, r.URL.Path)
+	if targetQuery == "" || r.URL.RawQuery == "" {
+		r.URL.RawQuery = targetQuery + r.URL.RawQuery
+	} else {
+		r.URL.RawQuery = targetQuery + "&" + r.URL.RawQuery
+	}
 
-			if !data.MaintainHost {
-				r.Host = r.URL.Host
-			}
-		},
+	log.Printf("[%s] %s %s %s > %s", ip, clientIP, r.Host, originalRequest.String(), r.URL.String())
+
+	forwardedFor := r.Header.Get(echo.XForwardedFor)
+	if forwardedFor != "" {
+		forwardedFor += ", " + clientIP
+	} else {
+		forwardedFor = clientIP
+	}
+
+	r.Header.Add("X-Remote-Addr", r.RemoteAddr)
+	r.Header.Add("X-Real-IP", clientIP)
+	r.Header.Add("X-Forwarded-For", forwardedFor)
+
+	for name, val := range data.SetHeader {
+		r.Header[name] = val
+	}
+
+	if !data.MaintainHost {
+		r.Host = r.URL.Host
 	}
 }
 
+// Whether the statesaver was started, it's settled before anything else runs and never changes
+var stateSaving bool
+
 func saveState() error {
-	writer, err := os.Create(config.StateSaver.File)
+	if atomic.LoadInt32(&handedOff) == 1 {
+		// It's the new process's to look after now
+		return nil
+	}
+	writer, err := os.Create(config().StateSaver.File)
 	if err != nil {
 		log.Println("Unable to save state:", err)
 		return err
 	}
 	defer writer.Close()
 	encoder := json.NewEncoder(writer)
-	return encoder.Encode(metaData)
+	return encoder.Encode(manager.snapshot())
 }
 
 func loadState() error {
-	reader, err := os.Open(config.StateSaver.File)
+	reader, err := os.Open(config().StateSaver.File)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -214,20 +308,32 @@ func loadState() error {
 	}
 	defer reader.Close()
 	decoder := json.NewDecoder(reader)
-	if err = decoder.Decode(&metaData); err != nil {
+	state := map[string]*proxyData{}
+	if err = decoder.Decode(&state); err != nil {
 		return err
 	}
 
-	for ip, data := range metaData {
-		proxy, ok := proxies[ip]
-		if !ok || proxy == nil {
+	for ip, saved := range state {
+		iface := manager.get(ip)
+		if iface == nil || saved == nil {
 			log.Printf("\tInterface %s doesn't exist, ignoring state", ip)
 			continue
 		}
 		log.Println("\tRestoring state for", ip)
 
-		if data.Enabled && data.Expire.After(time.Now()) {
-			proxy.Handler = proxyUpInterface(ip)
+		data, err := iface.update(func(data *proxyData) error {
+			*data = *saved
+			data.restore(ip)
+			data.Enabled = false
+			return nil
+		})
+		if err != nil {
+			log.Printf("\tUnable to restore state for %s: %s", ip, err)
+			continue
+		}
+
+		if saved.Enabled && data.Expire.After(time.Now()) {
+			iface.enable()
 		}
 	}
 
@@ -240,57 +346,125 @@ func main() {
 
 	log.Println("Loading configuration file")
 
-	var err error
-	config, err = loadConfiguration(*configFile)
+	loaded, err := loadConfiguration(*configFile)
 	if err != nil {
 		log.Printf("Problem parsing configuration file %s: %s\n", *configFile, err)
 		return
 	}
+	setConfig(loaded)
+
+	notifiers, err := newNotifiers(config())
+	if err != nil {
+		log.Fatal(err)
+	}
+	currentNotifiers.Store(notifiers)
 
 	log.Println("Initializing TLS configuration")
-	cer, err := tls.X509KeyPair(config.TLS.Certificate, config.TLS.Key)
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cer}}
+	cer, err := tls.X509KeyPair(config().TLS.Certificate, config().TLS.Key)
+	proxyCertificate.Store(&cer)
+	proxyTLSConfig = &tls.Config{GetCertificate: currentCertificate}
+	if !config().TLS.DisableHTTP2 {
+		proxyTLSConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+
+	if err = inheritListeners(); err != nil {
+		log.Fatal(err)
+	}
 
-	// Todo, make proxy interfaces an object, add mutex
+	// A member binds as a standby, it listens once it's elected
+	if config().Cluster.enabled() {
+		if cluster, err = newClusterNode(config().Cluster); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	log.Println("Binding proxy interfaces")
 	errors := false
-	for ip := range config.Addresses {
-		listener, err := tls.Listen("tcp", ip+":443", tlsConfig)
+	for ip, address := range config().Addresses {
 		log.Println("\tBinding", ip, ":443")
-		if err != nil {
+		if _, err = manager.bind(ip, address); err != nil {
 			log.Println(err)
 			errors = true
 		}
-		proxies[ip] = &http.Server{
-			Handler: proxyDownInterface(ip),
-		}
-
-		go proxies[ip].Serve(listener)
 	}
 
 	if errors {
 		log.Fatal("Please fix the above errors")
 	}
 
-	if config.StateSaver.Enabled && config.StateSaver.File != "" && config.StateSaver.Interval != nil {
-		log.Println("Enabling statesaver")
-		if err := loadState(); err != nil {
-			log.Println("Unable to load state")
+	if config().Discovery.enabled() {
+		log.Println("Discovering proxy interfaces")
+		if _, err = syncDiscovered(); err != nil {
+			log.Println("Unable to discover addresses:", err)
+		}
+	}
+
+	// Only now there are interfaces for the last snapshot to be restored into
+	if cluster != nil {
+		log.Println("Joining cluster as", config().Cluster.NodeID)
+		if err = cluster.join(config().Cluster); err != nil {
 			log.Fatal(err)
 		}
+	}
+
+	adminListener, err := listenTCP(adminListenerName, config().Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	closeInherited()
+
+	stateSaving = config().StateSaver.Enabled && config().StateSaver.File != "" && config().StateSaver.Interval != nil
+	if stateSaving {
+		log.Println("Enabling statesaver")
+		// A cluster member gets its state from the cluster
+		if cluster == nil {
+			if err := loadState(); err != nil {
+				log.Println("Unable to load state")
+				log.Fatal(err)
+			}
+		}
 		go func() {
-			for range time.Tick(config.StateSaver.Interval.Duration) {
+			for range time.Tick(config().StateSaver.Interval.Duration) {
 				saveState()
 			}
 		}()
-	} else {
-		config.StateSaver.Enabled = false
 	}
 
-	graceful.ListenAndServe(adminInterface().Server(config.Listen), 1*time.Second)
+	for _, ip := range manager.ips() {
+		manager.get(ip).serve()
+	}
+
+	go reloadOnSignal()
+	go discoverer()
+	if cluster != nil {
+		go cluster.watch()
+	}
+
+	// graceful looks after SIGINT and SIGTERM, once the admin interface is down so is everything else
+	admin := &graceful.Server{Server: adminInterface().Server(config().Listen), Timeout: 1 * time.Second}
+	go restartOnSignal(admin, adminListener)
+	notifySystemd(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+
+	exitCode := 0
+	if err := admin.Serve(adminListener); err != nil {
+		log.Println("Admin interface failed:", err)
+		exitCode |= exitAdminFailed
+	}
+
+	// Let the cluster know first so a standby can take over while this drains
+	cluster.stop()
 
-	if config.StateSaver.Enabled {
-		saveState()
+	log.Println("Shutting down proxy interfaces")
+	if !manager.shutdown() {
+		exitCode |= exitRequestsCutOff
 	}
+
+	if stateSaving {
+		if err := saveState(); err != nil {
+			exitCode |= exitStateNotSaved
+		}
+	}
+
+	log.Println("Exiting with", exitCode)
+	os.Exit(exitCode)
 }
@@ -0,0 +1,551 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// proxyInterface is a single public address. Its proxyData is never modified once published,
+// changes are made to a copy which then replaces it, so readers can hold on to what they got
+// from data() for as long as they like without locking
+type proxyInterface struct {
+	// First so they're 64 bit aligned for atomic
+	connections int64
+	lastRequest int64
+	budgetUsed  int64
+
+	ip      string
+	address ipAddressConfiguration
+	server  *http.Server
+	// The TCP listener is kept for handing over on restart, the server gets it wrapped in TLS
+	rawListener *net.TCPListener
+	listener    net.Listener
+	queue       *deliveryQueue
+	handler     atomic.Value
+	current     atomic.Value
+	// The last health check, it changes too often and says too little to go in proxyData
+	health atomic.Value
+
+	// Serializes changes, readers never need it
+	mutex sync.Mutex
+	// Closed to stop the expiry timer and health checker of the current enable
+	stop chan bool
+	// Wakes the scheduler up, and closing done stops it
+	rescheduled   chan struct{}
+	schedulerDone chan struct{}
+
+	inFlight inFlight
+}
+
+// ProxyManager owns every proxyInterface
+type ProxyManager struct {
+	sync.RWMutex
+	interfaces map[string]*proxyInterface
+}
+
+var manager = newProxyManager()
+
+// proxyTLSConfig is what every interface listens with, the certificate can be swapped on reload
+var (
+	proxyTLSConfig   *tls.Config
+	proxyCertificate atomic.Value
+)
+
+func currentCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return proxyCertificate.Load().(*tls.Certificate), nil
+}
+
+func newProxyManager() *ProxyManager {
+	return &ProxyManager{interfaces: map[string]*proxyInterface{}}
+}
+
+// bind listens on ip and adds a disabled interface for it, serve gets it going. A cluster standby
+// only adds it, it listens once it's in charge
+func (m *ProxyManager) bind(ip string, address ipAddressConfiguration) (*proxyInterface, error) {
+	var listener *net.TCPListener
+	if !cluster.standby() {
+		var err error
+		if listener, err = listenTCP(ip, net.JoinHostPort(ip, "443")); err != nil {
+			return nil, err
+		}
+	}
+	iface, err := m.add(ip, address)
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return nil, err
+	}
+	if listener != nil {
+		iface.attach(listener)
+	}
+	return iface, nil
+}
+
+// add sets up a disabled interface for ip, it's up to the caller to get the server serving
+func (m *ProxyManager) add(ip string, address ipAddressConfiguration) (*proxyInterface, error) {
+	iface := &proxyInterface{ip: ip, address: address}
+	iface.inFlight.requests = map[int64]context.CancelFunc{}
+	iface.inFlight.finished = make(chan struct{}, 1)
+	iface.rescheduled = make(chan struct{}, 1)
+	iface.schedulerDone = make(chan struct{})
+	iface.current.Store(newProxyData())
+	iface.setHandler(proxyDownInterface(ip))
+	iface.server = iface.newServer()
+
+	if config().Queue.Directory != "" {
+		var err error
+		if iface.queue, err = newDeliveryQueue(ip); err != nil {
+			return nil, err
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.interfaces[ip]; ok {
+		return nil, errors.New("Interface already exists")
+	}
+	m.interfaces[ip] = iface
+	if iface.queue != nil && !cluster.standby() {
+		iface.queue.start()
+	}
+	go iface.scheduler(iface.schedulerDone)
+	return iface, nil
+}
+
+// remove forgets about ip, disabling it and closing its listener. Requests in flight are given
+// the drain timeout to finish
+func (m *ProxyManager) remove(ip string) error {
+	m.Lock()
+	iface, ok := m.interfaces[ip]
+	delete(m.interfaces, ip)
+	m.Unlock()
+	if !ok {
+		return errors.New("Interface doesn't exist")
+	}
+	go iface.close()
+	return nil
+}
+
+// shutdown stops every interface at once, giving them all until the drain timeout. It returns
+// whether they all finished in time
+func (m *ProxyManager) shutdown() bool {
+	m.RLock()
+	ifaces := make([]*proxyInterface, 0, len(m.interfaces))
+	for _, iface := range m.interfaces {
+		ifaces = append(ifaces, iface)
+	}
+	m.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config().DrainTimeout.Duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var clean int32 = 1
+	for _, iface := range ifaces {
+		wg.Add(1)
+		go func(iface *proxyInterface) {
+			defer wg.Done()
+			if !iface.shutdown(ctx) {
+				atomic.StoreInt32(&clean, 0)
+			}
+		}(iface)
+	}
+	wg.Wait()
+	return clean == 1
+}
+
+// addresses is what /interfaces shows
+func (m *ProxyManager) addresses() ipAddressesConfiguration {
+	m.RLock()
+	defer m.RUnlock()
+	addresses := make(ipAddressesConfiguration, len(m.interfaces))
+	for ip, iface := range m.interfaces {
+		addresses[ip] = iface.address
+	}
+	return addresses
+}
+
+func (m *ProxyManager) describe(ip string, address ipAddressConfiguration) error {
+	m.Lock()
+	defer m.Unlock()
+	iface, ok := m.interfaces[ip]
+	if !ok {
+		return errors.New("Interface doesn't exist")
+	}
+	iface.address = address
+	return nil
+}
+
+func (m *ProxyManager) get(ip string) *proxyInterface {
+	m.RLock()
+	defer m.RUnlock()
+	return m.interfaces[ip]
+}
+
+func (m *ProxyManager) ips() []string {
+	m.RLock()
+	defer m.RUnlock()
+	ips := make([]string, 0, len(m.interfaces))
+	for ip := range m.interfaces {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// snapshot is the current data for every interface, fine to encode or hand out
+func (m *ProxyManager) snapshot() map[string]*proxyData {
+	m.RLock()
+	defer m.RUnlock()
+	snapshot := make(map[string]*proxyData, len(m.interfaces))
+	for ip, iface := range m.interfaces {
+		snapshot[ip] = iface.data()
+	}
+	return snapshot
+}
+
+func newProxyData() *proxyData {
+	return &proxyData{proxySettings: proxySettings{
+		TargetURL: &URL{},
+		SetHeader: make(http.Header),
+	}}
+}
+
+// ServeHTTP hands off to whichever handler is current, so enabling and disabling never touches
+// the http.Server while it's serving
+func (i *proxyInterface) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i.handler.Load().(handlerBox).ServeHTTP(w, r)
+}
+
+// handlerBox is what's kept in handler, atomic.Value needs the same type every time and the
+// handlers are anything from an echo to a HandlerFunc
+type handlerBox struct {
+	http.Handler
+}
+
+func (i *proxyInterface) setHandler(h http.Handler) {
+	i.handler.Store(handlerBox{h})
+}
+
+// tcpListener is what the interface is listening on, nil if it isn't
+func (i *proxyInterface) tcpListener() *net.TCPListener {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.rawListener
+}
+
+func (i *proxyInterface) newServer() *http.Server {
+	return &http.Server{
+		Handler:   i,
+		ConnState: i.trackConnections,
+	}
+}
+
+// listen is for interfaces that were added without listening, on taking charge of a cluster
+func (i *proxyInterface) listen() error {
+	listener, err := listenTCP(i.ip, net.JoinHostPort(i.ip, "443"))
+	if err != nil {
+		return err
+	}
+	i.attach(listener)
+	return nil
+}
+
+// attach gives the interface listener and a fresh server for it, servers can't be used again
+// once they've been shut down
+func (i *proxyInterface) attach(listener *net.TCPListener) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.rawListener = listener
+	i.listener = tls.NewListener(listener, proxyTLSConfig)
+	i.server = i.newServer()
+}
+
+// serve starts serving whatever it's listening on, if anything
+func (i *proxyInterface) serve() {
+	i.mutex.Lock()
+	server, listener := i.server, i.listener
+	i.mutex.Unlock()
+	if listener == nil {
+		return
+	}
+	if !config().TLS.DisableHTTP2 {
+		http2.ConfigureServer(server, nil)
+	}
+	go server.Serve(listener)
+}
+
+// close takes the interface down for good
+func (i *proxyInterface) close() {
+	log.Println("Closing proxy interface on", i.ip)
+	close(i.schedulerDone)
+	i.disable("Address removed", "")
+	ctx, cancel := context.WithTimeout(context.Background(), config().DrainTimeout.Duration)
+	defer cancel()
+	i.shutdown(ctx)
+}
+
+// shutdown stops accepting and waits for ctx for what's in flight to finish, cutting off whatever
+// hasn't. The proxy is left as it was, enabled or not, so it's saved that way. It returns
+// whether everything finished in time
+func (i *proxyInterface) shutdown(ctx context.Context) bool {
+	i.mutex.Lock()
+	if i.stop != nil {
+		close(i.stop)
+		i.stop = nil
+	}
+	server := i.server
+	i.rawListener, i.listener = nil, nil
+	i.mutex.Unlock()
+	if i.queue != nil {
+		i.queue.close()
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("[%s] %s, cutting off %d requests", i.ip, err, i.cutOff())
+		server.Close()
+		return false
+	}
+	return true
+}
+
+// data is the current snapshot, it must not be modified
+func (i *proxyInterface) data() *proxyData {
+	return i.current.Load().(*proxyData)
+}
+
+// update hands change a deep copy of the current data, publishing it if change and the
+// validation that follows are both happy
+func (i *proxyInterface) update(change func(*proxyData) error) (*proxyData, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.updateLocked(change)
+}
+
+func (i *proxyInterface) updateLocked(change func(*proxyData) error) (*proxyData, error) {
+	next, err := i.data().clone()
+	if err != nil {
+		return nil, err
+	}
+	if err = change(next); err != nil {
+		return nil, err
+	}
+	if err = next.validate(); err != nil {
+		return nil, err
+	}
+	if !next.Budget.same(i.data().Budget) {
+		atomic.StoreInt64(&i.budgetUsed, 0)
+	}
+	i.current.Store(next)
+	cluster.publish(i.ip, next)
+	i.reschedule()
+	return next, nil
+}
+
+// enable brings the proxy up (or keeps it up) until data.Expire, restarting the expiry timer
+func (i *proxyInterface) enable() (*proxyData, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if !i.data().Enabled {
+		// A fresh budget every time it's brought up, extending doesn't count
+		atomic.StoreInt64(&i.budgetUsed, 0)
+	}
+	data, err := i.updateLocked(func(data *proxyData) error {
+		data.Enabled = true
+		data.DisableReason = ""
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if i.stop != nil {
+		close(i.stop)
+	}
+	stop := make(chan bool)
+	i.stop = stop
+	// Anything still in flight from before is welcome to carry on
+	i.stopDrain(nil)
+	i.server.SetKeepAlivesEnabled(true)
+	i.setHandler(i.track(i.budgeted(stop, proxyUpInterface(i.ip))))
+
+	if i.queue != nil {
+		i.queue.wake()
+	}
+	go healthChecker(i.ip, stop)
+	go i.idleWatcher(stop, time.Now())
+	go i.expiryWarner(stop, data.Expire)
+	go func() {
+		select {
+		case <-time.After(data.Expire.Sub(time.Now())):
+			log.Println("Shutting down proxy interface on", i.ip)
+			i.disableIf(stop, reasonExpired)
+		case <-stop:
+		}
+	}()
+	return data, nil
+}
+
+// The reason given when the time's up
+const reasonExpired = "Expired"
+
+// disable takes the proxy down, reason is kept to say why and by is who did it if anybody did
+func (i *proxyInterface) disable(reason, by string) (*proxyData, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.disableLocked(reason, by)
+}
+
+// disableIf only disables if stop still belongs to the current enable, so a timer that fires
+// just as the proxy is extended can't take it down
+func (i *proxyInterface) disableIf(stop chan bool, reason string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.stop == stop {
+		i.disableLocked(reason, "")
+	}
+}
+
+func (i *proxyInterface) disableLocked(reason, by string) (*proxyData, error) {
+	was := i.data()
+	if i.stop != nil {
+		close(i.stop)
+		i.stop = nil
+	}
+	i.setHandler(proxyDownInterface(i.ip))
+	// Connections finishing up their last request shouldn't be kept around for another
+	i.server.SetKeepAlivesEnabled(false)
+	i.drain()
+	data, err := i.updateLocked(func(data *proxyData) error {
+		data.Enabled = false
+		data.DisableReason = reason
+		data.Disabled = time.Now()
+		return nil
+	})
+	if err == nil && was.Enabled {
+		event := eventDisabled
+		if reason == reasonExpired {
+			event = eventExpired
+		}
+		e := newNotification(event, i.ip, data)
+		e.Reason = reason
+		e.By = by
+		notify(e)
+	}
+	return data, err
+}
+
+// clone makes a deep copy by way of JSON, which conveniently is exactly what gets saved
+func (d *proxyData) clone() (*proxyData, error) {
+	encoded, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	clone := newProxyData()
+	if err = json.Unmarshal(encoded, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// restore compiles data that's come from elsewhere, the state file or the cluster, dropping
+// whatever won't compile
+func (d *proxyData) restore(ip string) {
+	if err := compileMocks(d.Mocks); err != nil {
+		log.Printf("\tUnable to restore mocks for %s: %s", ip, err)
+		d.Mocks = nil
+	}
+	if err := compileFaults(d.Faults); err != nil {
+		log.Printf("\tUnable to restore faults for %s: %s", ip, err)
+		d.Faults = nil
+	}
+	if err := compileRewrites(d.Rewrites); err != nil {
+		log.Printf("\tUnable to restore rewrites for %s: %s", ip, err)
+		d.Rewrites = nil
+	}
+	if err := compileHeaderRules(d.HeaderRules); err != nil {
+		log.Printf("\tUnable to restore header rules for %s: %s", ip, err)
+		d.HeaderRules = nil
+	}
+	if err := compileSchedule(d.Schedule); err != nil {
+		log.Printf("\tUnable to restore schedule for %s: %s", ip, err)
+		d.Schedule = nil
+	}
+	if err := d.Budget.compile(); err != nil {
+		log.Printf("\tUnable to restore request budget for %s: %s", ip, err)
+		d.Budget = nil
+	}
+}
+
+// validate checks everything a user can set and compiles the patterns and templates
+func (d *proxyData) validate() error {
+	if d.TargetURL == nil {
+		d.TargetURL = &URL{}
+	}
+	if d.SetHeader == nil {
+		d.SetHeader = make(http.Header)
+	}
+	if !validProtocol(d.Protocol) {
+		return errors.New("Unknown protocol, expected one of http/1.1, h2 or h2c")
+	}
+	if !validMode(d.Mode) {
+		return errors.New("Unknown mode, expected one of proxy, mock or fanout")
+	}
+	if err := compileMocks(d.Mocks); err != nil {
+		return err
+	}
+	if err := compileFaults(d.Faults); err != nil {
+		return err
+	}
+	if err := compileRewrites(d.Rewrites); err != nil {
+		return err
+	}
+	if err := compileHeaderRules(d.HeaderRules); err != nil {
+		return err
+	}
+	if err := compileSchedule(d.Schedule); err != nil {
+		return err
+	}
+	if err := d.Budget.compile(); err != nil {
+		return err
+	}
+	for _, shadow := range d.Shadows {
+		if shadow == nil || shadow.URL == nil || shadow.Scheme == "" || shadow.Host == "" {
+			return errors.New("Shadow targets must be absolute URLs")
+		}
+	}
+	return d.FanOut.validate()
+}
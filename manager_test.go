@@ -0,0 +1,106 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run with -race, enabling, disabling, changing and looking at a proxy all at once while it's
+// being called
+func TestProxyInterfaceConcurrency(t *testing.T) {
+	setConfig(&configuration{
+		DrainTimeout: duration{time.Second},
+		Traffic:      trafficConfiguration{History: 10, BodyLimit: 1024},
+	})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+
+	ip := "192.0.2.37"
+	iface, err := manager.add(ip, ipAddressConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.remove(ip)
+	if _, err = iface.update(func(data *proxyData) error {
+		data.TargetURL = &URL{targetURL}
+		data.Expire = time.Now().Add(time.Hour)
+		data.Record = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	run := func(name string, f func(n int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				if err := f(n); err != nil {
+					t.Errorf("%s: %s", name, err)
+					return
+				}
+			}
+		}()
+	}
+	run("enable", func(int) error {
+		_, err := iface.enable()
+		return err
+	})
+	run("disable", func(int) error {
+		_, err := iface.disable("Disabled by test", "test")
+		return err
+	})
+	run("update", func(n int) error {
+		_, err := iface.update(func(data *proxyData) error {
+			data.Comment = fmt.Sprintf("update %d", n)
+			data.Budget = &requestBudget{Limit: n%5 + 1}
+			return nil
+		})
+		return err
+	})
+	run("view", func(int) error {
+		_, err := json.Marshal(iface.view())
+		return err
+	})
+	run("request", func(int) error {
+		w := httptest.NewRecorder()
+		iface.ServeHTTP(w, httptest.NewRequest("GET", "https://"+ip+"/callback", nil))
+		return nil
+	})
+	wg.Wait()
+
+	if data := iface.data(); data.Comment != "update 49" {
+		t.Errorf("Expected the last update to stick, got %q", data.Comment)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// requestMatcher picks requests out by method and path, embedded by anything that needs scoping
+type requestMatcher struct {
+	// Empty matches any method
+	Method string
+	// Regular expression matched against the whole path, empty matches any path
+	Path string
+
+	pathRegexp *regexp.Regexp
+}
+
+func (m *requestMatcher) compile() (err error) {
+	if m.Path == "" {
+		m.Path = ".*"
+	}
+	if m.pathRegexp, err = regexp.Compile("^(?:" + m.Path + ")$"); err != nil {
+		return fmt.Errorf("Unable to compile path %q: %s", m.Path, err)
+	}
+	return nil
+}
+
+// match returns the path capture groups, or nil if the request doesn't match
+func (m *requestMatcher) match(r *http.Request) []string {
+	if m.pathRegexp == nil {
+		return nil
+	}
+	if m.Method != "" && !strings.EqualFold(m.Method, r.Method) {
+		return nil
+	}
+	return m.pathRegexp.FindStringSubmatch(r.URL.Path)
+}
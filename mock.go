@@ -0,0 +1,133 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+)
+
+const (
+	modeProxy = "proxy"
+	modeMock  = "mock"
+)
+
+// Don't let a mock template slurp an enormous upload
+const mockMaxBody = 1 << 20
+
+type mockResponse struct {
+	requestMatcher
+	Status int
+	Header http.Header
+	Body   string
+
+	bodyTemplate *template.Template
+}
+
+type mockRequest struct {
+	Method   string
+	Host     string
+	Path     string
+	Query    url.Values
+	Header   http.Header
+	Body     string
+	Match    []string
+	ClientIP string
+	Now      time.Time
+}
+
+func validMode(mode string) bool {
+	switch mode {
+	case "", modeProxy, modeMock, modeFanOut:
+		return true
+	}
+	return false
+}
+
+func (m *mockResponse) compile() (err error) {
+	if err = m.requestMatcher.compile(); err != nil {
+		return
+	}
+	if m.bodyTemplate, err = template.New("body").Parse(m.Body); err != nil {
+		return fmt.Errorf("Unable to compile body template for %q: %s", m.Path, err)
+	}
+	return nil
+}
+
+func compileMocks(mocks []*mockResponse) error {
+	for _, m := range mocks {
+		if err := m.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serveMock(ip string, mocks []*mockResponse, w http.ResponseWriter, r *http.Request) {
+	clientIP := clientIP(r)
+	for _, m := range mocks {
+		match := m.match(r)
+		if match == nil {
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, mockMaxBody))
+		var buffer bytes.Buffer
+		err := m.bodyTemplate.Execute(&buffer, mockRequest{
+			Method:   r.Method,
+			Host:     r.Host,
+			Path:     r.URL.Path,
+			Query:    r.URL.Query(),
+			Header:   r.Header,
+			Body:     string(body),
+			Match:    match,
+			ClientIP: clientIP,
+			Now:      time.Now(),
+		})
+		if err != nil {
+			log.Printf("[%s] %s %s %s mock template failed: %s", ip, clientIP, r.Host, r.URL.String(), err)
+			http.Error(w, "Mock template failed", http.StatusInternalServerError)
+			return
+		}
+
+		status := m.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		log.Printf("[%s] %s %s %s mocked %d", ip, clientIP, r.Host, r.URL.String(), status)
+
+		for name, val := range m.Header {
+			w.Header()[name] = val
+		}
+		w.WriteHeader(status)
+		buffer.WriteTo(w)
+		return
+	}
+
+	log.Printf("[%s] %s %s %s no mock matched", ip, clientIP, r.Host, r.URL.String())
+	http.Error(w, "No mock response matched", http.StatusNotFound)
+}
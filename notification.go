@@ -0,0 +1,312 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What there is to be told about
+const (
+	eventEnabled  = "enabled"
+	eventUpdated  = "updated"
+	eventExtended = "extended"
+	eventExpiring = "expiring"
+	eventExpired  = "expired"
+	eventDisabled = "disabled"
+)
+
+var notificationEvents = []string{eventEnabled, eventUpdated, eventExtended, eventExpiring, eventExpired, eventDisabled}
+
+type notificationConfiguration struct {
+	// How long before expiry to warn, every one of them gets its own warning
+	ExpiryWarnings  []duration `toml:"expiry_warnings"`
+	PreferencesFile string     `toml:"preferences_file"`
+}
+
+// notificationEvent is what's sent, Who is whoever the proxy belongs to and By whoever did it
+// when that's somebody else
+type notificationEvent struct {
+	ID    string
+	Event string
+	Time  time.Time
+	IP    string
+	Who   string
+	// Who's email address, there's no need to go handing it out
+	WhoMail   string `json:"-"`
+	By        string `json:",omitempty"`
+	Comment   string
+	TargetURL *URL
+	Expire    time.Time
+	// How long until it expires, for expiring
+	In     duration
+	Reason string `json:",omitempty"`
+}
+
+var notificationSeq uint32
+
+func newNotification(event, ip string, data *proxyData) *notificationEvent {
+	now := time.Now()
+	return &notificationEvent{
+		ID:        fmt.Sprintf("%d-%d", now.UnixNano(), atomic.AddUint32(&notificationSeq, 1)),
+		Event:     event,
+		Time:      now,
+		IP:        ip,
+		Who:       data.Who,
+		WhoMail:   data.WhoMail,
+		Comment:   data.Comment,
+		TargetURL: data.TargetURL,
+		Expire:    data.Expire,
+	}
+}
+
+// The notifiers in use, built afresh on reload like adminSecurity
+var currentNotifiers atomic.Value
+
+func newNotifiers(c *configuration) ([]NotificationInterface, error) {
+	log.Println("Configuring notification interfaces")
+	notifiers := []NotificationInterface{}
+	for name := range notificationInterfaces {
+		notifier := GetNotificationInterface(name)
+		if err := notifier.Init(c); err != nil {
+			log.Printf("Unable to initialize %s notifications", name)
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, nil
+}
+
+// notify hands e to every notifier along with the owner's preferences, it never blocks
+func notify(e *notificationEvent) {
+	// The leader speaks for the cluster
+	if cluster.standby() {
+		return
+	}
+	notifiers, _ := currentNotifiers.Load().([]NotificationInterface)
+	if len(notifiers) == 0 {
+		return
+	}
+
+	preferences := &notificationPreferences{}
+	if e.Who != "" {
+		var err error
+		if preferences, err = getPreferences(e.Who); err != nil {
+			log.Printf("[%s] Unable to read notification preferences for %s: %s", e.IP, e.Who, err)
+			preferences = &notificationPreferences{}
+		}
+	}
+	for _, notifier := range notifiers {
+		go notifier.Notify(e, preferences)
+	}
+}
+
+// wants is whether a list of events, empty being all of them, includes event
+func wants(events []string, event string) bool {
+	if len(events) == 0 {
+		return true
+	}
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validEvents(events []string) error {
+	for _, event := range events {
+		if !wants(notificationEvents, event) {
+			return fmt.Errorf("Unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// expiryWarner sends the expiring notifications for an enable, warnings that are already past
+// when it's enabled (or extended) are skipped
+func (i *proxyInterface) expiryWarner(stop chan bool, expire time.Time) {
+	warnings := []time.Duration{}
+	for _, warning := range config().Notifications.ExpiryWarnings {
+		warnings = append(warnings, warning.Duration)
+	}
+	// Furthest out first
+	sort.Slice(warnings, func(a, b int) bool { return warnings[a] > warnings[b] })
+
+	for _, warning := range warnings {
+		wait := expire.Add(-warning).Sub(time.Now())
+		if wait < 0 || warning <= 0 {
+			continue
+		}
+		select {
+		case <-time.After(wait):
+			e := newNotification(eventExpiring, i.ip, i.data())
+			e.In = duration{warning}
+			notify(e)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// notificationPreferences is what a user wants to hear about their own proxies and where
+type notificationPreferences struct {
+	// Empty for everything
+	Events []string
+	// Posted to like any other webhook, signed with Secret
+	Webhook string
+	Secret  string
+	// Email goes to the address from the directory unless there's another here
+	Email   string
+	NoEmail bool
+}
+
+func (p *notificationPreferences) validate() error {
+	if err := validEvents(p.Events); err != nil {
+		return err
+	}
+	if p.Email != "" {
+		if _, err := mail.ParseAddress(p.Email); err != nil {
+			return err
+		}
+	}
+	if p.Webhook != "" {
+		u, err := url.Parse(p.Webhook)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.New("Webhook has to be http or https")
+		}
+	}
+	return nil
+}
+
+// Serializes changes to the preferences file
+var preferencesMutex sync.Mutex
+
+// loadPreferences reads every user's preferences from file, if there is one
+func loadPreferences(file string) (map[string]*notificationPreferences, error) {
+	preferences := map[string]*notificationPreferences{}
+	reader, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return preferences, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	err = json.NewDecoder(reader).Decode(&preferences)
+	return preferences, err
+}
+
+// getPreferences is user's preferences, the defaults if they haven't said
+func getPreferences(user string) (*notificationPreferences, error) {
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+	file := config().Notifications.PreferencesFile
+	if file == "" {
+		return &notificationPreferences{}, nil
+	}
+	preferences, err := loadPreferences(file)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := preferences[user]; ok {
+		return p, nil
+	}
+	return &notificationPreferences{}, nil
+}
+
+// setPreferences replaces user's preferences and hands them to the rest of the cluster
+func setPreferences(user string, p *notificationPreferences) error {
+	if err := storePreferences(user, p); err != nil {
+		return err
+	}
+	cluster.publishPreferences(user, p)
+	return nil
+}
+
+// storePreferences replaces user's preferences in this node's file
+func storePreferences(user string, p *notificationPreferences) error {
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+	file := config().Notifications.PreferencesFile
+	if file == "" {
+		return errors.New("There's nowhere to keep notification preferences")
+	}
+	preferences, err := loadPreferences(file)
+	if err != nil {
+		return err
+	}
+	preferences[user] = p
+	return savePreferences(file, preferences)
+}
+
+// allPreferences is everybody's preferences, for a cluster snapshot
+func allPreferences() (map[string]*notificationPreferences, error) {
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+	file := config().Notifications.PreferencesFile
+	if file == "" {
+		return map[string]*notificationPreferences{}, nil
+	}
+	return loadPreferences(file)
+}
+
+// replacePreferences swaps everybody's preferences for the ones in a cluster snapshot
+func replacePreferences(preferences map[string]*notificationPreferences) error {
+	preferencesMutex.Lock()
+	defer preferencesMutex.Unlock()
+	file := config().Notifications.PreferencesFile
+	if file == "" {
+		return nil
+	}
+	return savePreferences(file, preferences)
+}
+
+// savePreferences writes the preferences out via a temporary file
+func savePreferences(file string, preferences map[string]*notificationPreferences) error {
+	writer, err := os.OpenFile(file+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "\t")
+	if err = encoder.Encode(preferences); err != nil {
+		writer.Close()
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
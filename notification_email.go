@@ -0,0 +1,232 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const emailNotificationName = "email"
+
+// MailResolver is implemented by authentication and access control modules that know people's
+// email addresses
+type MailResolver interface {
+	Mail(c EchoStasher, user string) (string, error)
+}
+
+// resolveMail asks access control then authentication for user's address, whoever knows first wins
+func resolveMail(c EchoStasher, user string) string {
+	security := currentSecurity.Load().(*adminSecurity)
+	for _, module := range []interface{}{security.accessControl, security.authentication} {
+		resolver, ok := module.(MailResolver)
+		if !ok {
+			continue
+		}
+		address, err := resolver.Mail(c, user)
+		if err != nil {
+			log.Printf("Unable to look up the email address for %s: %s", user, err)
+			continue
+		}
+		if address != "" {
+			return address
+		}
+	}
+	return ""
+}
+
+type emailNotification struct {
+	config  emailNotificationConfiguration
+	subject *template.Template
+	body    *template.Template
+	enabled bool
+}
+
+type emailNotificationConfiguration struct {
+	// The SMTP relay, host:port
+	Address  string   `toml:"address"`
+	Username string   `toml:"username"`
+	Password string   `toml:"password"`
+	From     string   `toml:"from"`
+	Events   []string `toml:"events"`
+	Subject  string   `toml:"subject"`
+	Body     string   `toml:"body"`
+	Attempts int      `toml:"attempts"`
+	RetryMin duration `toml:"retry_min"`
+}
+
+const emailNotificationSubject = `{{if eq .Event "expiring"}}Your proxy on {{.IP}} expires in {{.In}}{{else}}Your proxy on {{.IP}} was {{.Event}}{{end}}`
+
+const emailNotificationBody = `Hi {{.Who}},
+
+{{if eq .Event "expiring"}}Your proxy on {{.IP}} expires at {{.Expire.Format "15:04 MST"}}, extend it if you still need it.
+{{else if eq .Event "expired"}}Your proxy on {{.IP}} has expired.
+{{else}}Your proxy on {{.IP}} was {{.Event}}{{if .By}} by {{.By}}{{end}}{{if .Reason}} ({{.Reason}}){{end}}.
+{{end}}
+Forwarded to: {{with .TargetURL}}{{if .URL}}{{.}}{{else}}nowhere{{end}}{{else}}nowhere{{end}}
+Comment: {{.Comment}}
+
+-- 
+zookeeper
+`
+
+func (n *emailNotification) Init(c *configuration) (err error) {
+	log.Println("emailNotification initializing")
+	n.config = emailNotificationConfiguration{
+		Events:   []string{eventExpiring, eventExpired, eventDisabled},
+		Subject:  emailNotificationSubject,
+		Body:     emailNotificationBody,
+		Attempts: 3,
+		RetryMin: duration{30 * time.Second},
+	}
+
+	if err = c.UnifyNotifierConfiguration(emailNotificationName, &n.config); err != nil {
+		return
+	}
+
+	log.Println("\tVerifying configuration")
+	configured := n.config.Address != ""
+	configured = configured && n.config.From != ""
+
+	if !configured {
+		log.Println("emailNotification not configured")
+		return
+	}
+
+	if _, _, err = net.SplitHostPort(n.config.Address); err != nil {
+		return
+	}
+	if _, err = mail.ParseAddress(n.config.From); err != nil {
+		return fmt.Errorf("Invalid from address: %s", err)
+	}
+	if err = validEvents(n.config.Events); err != nil {
+		return
+	}
+
+	log.Println("\tCompiling templates")
+	if n.subject, err = template.New("subject").Parse(n.config.Subject); err != nil {
+		return
+	}
+	if n.body, err = template.New("body").Parse(n.config.Body); err != nil {
+		return
+	}
+
+	n.enabled = true
+	log.Println("emailNotification ready")
+	return
+}
+
+// Notify emails the owner, disabling something yourself isn't worth an email
+func (n *emailNotification) Notify(e *notificationEvent, preferences *notificationPreferences) {
+	if !n.enabled || preferences.NoEmail {
+		return
+	}
+	if !wants(n.config.Events, e.Event) || !wants(preferences.Events, e.Event) {
+		return
+	}
+	if e.Event == eventDisabled && e.By != "" && e.By == e.Who {
+		return
+	}
+	to := preferences.Email
+	if to == "" {
+		to = e.WhoMail
+	}
+	if to == "" {
+		return
+	}
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		log.Printf("[%s] Unable to email %s notification to %q: %s", e.IP, e.Event, to, err)
+		return
+	}
+
+	message, err := n.message(recipient, e)
+	if err != nil {
+		log.Printf("[%s] Unable to write %s email: %s", e.IP, e.Event, err)
+		return
+	}
+
+	wait := n.config.RetryMin.Duration
+	for attempt := 1; ; attempt++ {
+		if err = n.send(recipient, message); err == nil {
+			return
+		}
+		if attempt >= n.config.Attempts {
+			log.Printf("[%s] Gave up emailing %s notification to %s after %d attempt(s): %s", e.IP, e.Event, to, attempt, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// message fills in the templates, the subject is folded onto one line
+func (n *emailNotification) message(to *mail.Address, e *notificationEvent) ([]byte, error) {
+	subject := &bytes.Buffer{}
+	if err := n.subject.Execute(subject, e); err != nil {
+		return nil, err
+	}
+	body := &bytes.Buffer{}
+	if err := n.body.Execute(body, e); err != nil {
+		return nil, err
+	}
+
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(message, "To: %s\r\n", to.String())
+	fmt.Fprintf(message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")))
+	fmt.Fprintf(message, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(message, "Message-ID: <%s.%s@zookeeper>\r\n", e.ID, e.Event)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.Replace(body.String(), "\n", "\r\n", -1))
+	return message.Bytes(), nil
+}
+
+// send goes through the relay, which gets to decide about STARTTLS
+func (n *emailNotification) send(to *mail.Address, message []byte) error {
+	from, err := mail.ParseAddress(n.config.From)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if n.config.Username != "" {
+		host, _, _ := net.SplitHostPort(n.config.Address)
+		auth = smtp.PlainAuth("", n.config.Username, n.config.Password, host)
+	}
+	return smtp.SendMail(n.config.Address, auth, from.Address, []string{to.Address}, message)
+}
+
+func init() {
+	RegisterNotificationInterface(emailNotificationName, func() NotificationInterface {
+		return &emailNotification{}
+	})
+}
@@ -0,0 +1,185 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// receivedMail is what the stand-in SMTP server was given
+type receivedMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// smtpStandIn is just enough of an SMTP server for net/smtp to send to, no STARTTLS or AUTH
+func smtpStandIn(t *testing.T) (string, chan receivedMail, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan receivedMail, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, received)
+		}
+	}()
+	return listener.Addr().String(), received, func() { listener.Close() }
+}
+
+func serveSMTP(conn net.Conn, received chan receivedMail) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	mail := receivedMail{}
+	text.PrintfLine("220 localhost stand-in")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "MAIL":
+			mail.From = strings.Trim(line[strings.Index(line, ":")+1:], "<> ")
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			mail.To = append(mail.To, strings.Trim(line[strings.Index(line, ":")+1:], "<> "))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			lines, err := text.ReadDotLines()
+			if err != nil {
+				return
+			}
+			mail.Data = strings.Join(lines, "\n")
+			received <- mail
+			mail = receivedMail{}
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func testEmailNotification(address string) *emailNotification {
+	return &emailNotification{
+		config: emailNotificationConfiguration{
+			Address:  address,
+			From:     "ZooKeeper <zookeeper@example.com>",
+			Events:   []string{eventExpiring, eventExpired, eventDisabled},
+			Attempts: 1,
+		},
+		subject: template.Must(template.New("subject").Parse(emailNotificationSubject)),
+		body:    template.Must(template.New("body").Parse(emailNotificationBody)),
+		enabled: true,
+	}
+}
+
+func testEmailEvent(event string) *notificationEvent {
+	data := newProxyData()
+	data.Who = "swynter"
+	data.WhoMail = "shannon@example.com"
+	data.Comment = "email test"
+	data.Expire = time.Now().Add(15 * time.Minute)
+	e := newNotification(event, "192.0.2.50", data)
+	e.In = duration{15 * time.Minute}
+	return e
+}
+
+func TestEmailNotification(t *testing.T) {
+	address, received, stop := smtpStandIn(t)
+	defer stop()
+	n := testEmailNotification(address)
+
+	n.Notify(testEmailEvent(eventExpiring), &notificationPreferences{})
+	mail := <-received
+	if mail.From != "zookeeper@example.com" || len(mail.To) != 1 || mail.To[0] != "shannon@example.com" {
+		t.Errorf("Expected mail from zookeeper to the owner, got %s to %v", mail.From, mail.To)
+	}
+	for _, expected := range []string{
+		"To: <shannon@example.com>",
+		"Subject: Your proxy on 192.0.2.50 expires in 15m0s",
+		"Hi swynter",
+		"Comment: email test",
+	} {
+		if !strings.Contains(mail.Data, expected) {
+			t.Errorf("Expected %q in\n%s", expected, mail.Data)
+		}
+	}
+
+	// Somewhere else if they'd rather
+	n.Notify(testEmailEvent(eventExpired), &notificationPreferences{Email: "elsewhere@example.com"})
+	if mail = <-received; mail.To[0] != "elsewhere@example.com" {
+		t.Errorf("Expected mail to the preferred address, got %v", mail.To)
+	}
+
+	// Nothing when they did it themselves, don't want it or it isn't an event that's emailed
+	disabled := testEmailEvent(eventDisabled)
+	disabled.By = "swynter"
+	n.Notify(disabled, &notificationPreferences{})
+	n.Notify(testEmailEvent(eventExpiring), &notificationPreferences{NoEmail: true})
+	n.Notify(testEmailEvent(eventExpiring), &notificationPreferences{Events: []string{eventExpired}})
+	n.Notify(testEmailEvent(eventEnabled), &notificationPreferences{})
+
+	// But when somebody else did
+	disabled.By = "someone.else"
+	n.Notify(disabled, &notificationPreferences{})
+	mail = <-received
+	if !strings.Contains(mail.Data, "was disabled by someone.else") {
+		t.Errorf("Expected the only other mail to be somebody else disabling it, got\n%s", mail.Data)
+	}
+	select {
+	case mail = <-received:
+		t.Errorf("Expected no more mail, got\n%s", mail.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOwnerMailNotShown(t *testing.T) {
+	iface := &proxyInterface{}
+	data := newProxyData()
+	data.WhoMail = "shannon@example.com"
+	iface.current.Store(data)
+
+	shown, err := json.Marshal(iface.view())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(shown), "shannon@example.com") {
+		t.Errorf("Expected the owner's address to be left out, got %s", shown)
+	}
+	if iface.data().WhoMail == "" {
+		t.Error("Expected the owner's address to be kept")
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const webhookNotificationName = "webhook"
+
+type webhookNotification struct {
+	config  webhookNotificationConfiguration
+	client  *http.Client
+	enabled bool
+}
+
+type webhookNotificationConfiguration struct {
+	// Used for hooks that don't have their own
+	Secret   string          `toml:"secret"`
+	Attempts int             `toml:"attempts"`
+	RetryMin duration        `toml:"retry_min"`
+	RetryMax duration        `toml:"retry_max"`
+	Timeout  duration        `toml:"timeout"`
+	Hooks    []webhookTarget `toml:"hook"`
+}
+
+// webhookTarget gets every event it asks for, about everybody's proxies
+type webhookTarget struct {
+	URL    string   `toml:"url"`
+	Secret string   `toml:"secret"`
+	Events []string `toml:"events"`
+}
+
+func (n *webhookNotification) Init(c *configuration) (err error) {
+	log.Println("webhookNotification initializing")
+	n.config = webhookNotificationConfiguration{
+		Attempts: 5,
+		RetryMin: duration{5 * time.Second},
+		RetryMax: duration{5 * time.Minute},
+		Timeout:  duration{10 * time.Second},
+	}
+
+	if !c.md.IsDefined("notifier", webhookNotificationName) {
+		log.Println("webhookNotification not configured")
+		return
+	}
+	if err = c.UnifyNotifierConfiguration(webhookNotificationName, &n.config); err != nil {
+		return
+	}
+
+	log.Println("\tVerifying configuration")
+	for _, hook := range n.config.Hooks {
+		if hook.URL == "" {
+			return fmt.Errorf("Webhook without a url")
+		}
+		if err = validEvents(hook.Events); err != nil {
+			return fmt.Errorf("Webhook %s: %s", hook.URL, err)
+		}
+	}
+
+	n.client = &http.Client{Timeout: n.config.Timeout.Duration}
+	n.enabled = true
+	log.Println("webhookNotification ready")
+	return
+}
+
+func (n *webhookNotification) Notify(e *notificationEvent, preferences *notificationPreferences) {
+	if !n.enabled {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("[%s] Unable to encode %s notification: %s", e.IP, e.Event, err)
+		return
+	}
+
+	for _, hook := range n.config.Hooks {
+		if wants(hook.Events, e.Event) {
+			go n.deliver(hook, e, body)
+		}
+	}
+	if preferences.Webhook != "" && wants(preferences.Events, e.Event) {
+		go n.deliver(webhookTarget{URL: preferences.Webhook, Secret: preferences.Secret}, e, body)
+	}
+}
+
+// deliver keeps trying with backoff until the hook takes it, gives up on anything but a server error
+// or too many requests since trying again won't help
+func (n *webhookNotification) deliver(hook webhookTarget, e *notificationEvent, body []byte) {
+	secret := hook.Secret
+	if secret == "" {
+		secret = n.config.Secret
+	}
+	wait := n.config.RetryMin.Duration
+	for attempt := 1; ; attempt++ {
+		status, err := n.post(hook.URL, secret, e, body)
+		if err == nil && status < 300 {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("%d %s", status, http.StatusText(status))
+		}
+		if attempt >= n.config.Attempts || (status != 0 && status < 500 && status != http.StatusTooManyRequests) {
+			log.Printf("[%s] Gave up sending %s notification to %s after %d attempt(s): %s", e.IP, e.Event, hook.URL, attempt, err)
+			return
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > n.config.RetryMax.Duration {
+			wait = n.config.RetryMax.Duration
+		}
+	}
+}
+
+// post sends body signed with secret, the signature is a hex HMAC-SHA256 of the body
+func (n *webhookNotification) post(url, secret string, e *notificationEvent, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "zookeeper")
+	req.Header.Set("X-Zookeeper-Event", e.Event)
+	req.Header.Set("X-Zookeeper-Delivery", e.ID)
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Zookeeper-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func init() {
+	RegisterNotificationInterface(webhookNotificationName, func() NotificationInterface {
+		return &webhookNotification{}
+	})
+}
@@ -0,0 +1,213 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// webhookStandIn answers with statuses in turn, the last one over and over, and passes on
+// every request it gets
+func webhookStandIn(statuses ...int) (*httptest.Server, chan *http.Request, chan []byte, *int32) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&count, 1))
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.WriteHeader(statuses[n-1])
+	}))
+	return server, requests, bodies, &count
+}
+
+func testWebhookNotification(hooks ...webhookTarget) *webhookNotification {
+	return &webhookNotification{
+		config: webhookNotificationConfiguration{
+			Secret:   "shared secret",
+			Attempts: 3,
+			RetryMin: duration{time.Millisecond},
+			RetryMax: duration{5 * time.Millisecond},
+			Hooks:    hooks,
+		},
+		client:  &http.Client{Timeout: time.Second},
+		enabled: true,
+	}
+}
+
+func testNotification(event string) *notificationEvent {
+	data := newProxyData()
+	data.Who = "swynter"
+	data.Comment = "webhook test"
+	return newNotification(event, "192.0.2.49", data)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	server, requests, bodies, _ := webhookStandIn(http.StatusOK)
+	defer server.Close()
+
+	n := testWebhookNotification()
+	e := testNotification(eventExpiring)
+	body, _ := json.Marshal(e)
+	n.deliver(webhookTarget{URL: server.URL}, e, body)
+
+	r, received := <-requests, <-bodies
+	mac := hmac.New(sha256.New, []byte("shared secret"))
+	mac.Write(received)
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-Zookeeper-Signature") != expected {
+		t.Errorf("Expected signature %s, got %s", expected, r.Header.Get("X-Zookeeper-Signature"))
+	}
+	if r.Header.Get("X-Zookeeper-Event") != eventExpiring || r.Header.Get("X-Zookeeper-Delivery") != e.ID {
+		t.Errorf("Expected event and delivery headers, got %v", r.Header)
+	}
+	sent := notificationEvent{}
+	if err := json.Unmarshal(received, &sent); err != nil || sent.Comment != "webhook test" {
+		t.Errorf("Expected the event as the body, got %s", received)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		statuses []int
+		attempts int32
+	}{
+		{"server error then success", []int{http.StatusBadGateway, http.StatusOK}, 2},
+		{"server errors until giving up", []int{http.StatusInternalServerError}, 3},
+		{"too many requests", []int{http.StatusTooManyRequests, http.StatusNoContent}, 2},
+		{"client error", []int{http.StatusBadRequest}, 1},
+	} {
+		server, _, _, count := webhookStandIn(test.statuses...)
+		n := testWebhookNotification()
+		e := testNotification(eventExpired)
+		body, _ := json.Marshal(e)
+		n.deliver(webhookTarget{URL: server.URL}, e, body)
+		server.Close()
+		if attempts := atomic.LoadInt32(count); attempts != test.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.name, test.attempts, attempts)
+		}
+	}
+}
+
+func TestWebhookPreferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zookeeper-notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setConfig(&configuration{Notifications: notificationConfiguration{PreferencesFile: filepath.Join(dir, "notifications")}})
+
+	hook, hookRequests, _, _ := webhookStandIn(http.StatusOK)
+	defer hook.Close()
+	own, ownRequests, _, _ := webhookStandIn(http.StatusOK)
+	defer own.Close()
+
+	if err = setPreferences("swynter", &notificationPreferences{
+		Events:  []string{eventExpiring},
+		Webhook: own.URL,
+		Secret:  "only I know this",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	preferences, err := getPreferences("swynter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := testWebhookNotification(webhookTarget{URL: hook.URL, Events: []string{eventExpired}})
+	n.Notify(testNotification(eventExpiring), preferences)
+	select {
+	case r := <-ownRequests:
+		if r.Header.Get("X-Zookeeper-Signature") == "" {
+			t.Error("Expected the user's webhook to be signed with their secret")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the user's webhook to get what they asked for")
+	}
+
+	n.Notify(testNotification(eventExpired), preferences)
+	select {
+	case <-hookRequests:
+	case <-time.After(time.Second):
+		t.Error("Expected the configured webhook to get what it asked for")
+	}
+	select {
+	case <-ownRequests:
+		t.Error("Expected the user's webhook not to get what they didn't ask for")
+	case <-hookRequests:
+		t.Error("Expected the configured webhook not to get what it didn't ask for")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPreferencesReplicated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zookeeper-notifications")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setConfig(&configuration{Notifications: notificationConfiguration{PreferencesFile: filepath.Join(dir, "notifications")}})
+
+	// Never elected, so it takes on whatever it's sent
+	standby := &clusterNode{}
+	entry, _ := json.Marshal(clusterCommand{User: "swynter", Preferences: &notificationPreferences{Events: []string{eventExpired}}})
+	if result := standby.Apply(&raft.Log{Data: entry}); result != nil {
+		t.Fatal(result)
+	}
+	preferences, err := getPreferences("swynter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preferences.Events) != 1 || preferences.Events[0] != eventExpired {
+		t.Errorf("Expected the replicated preferences, got %+v", preferences)
+	}
+
+	snapshot, _ := json.Marshal(clusterSnapshot{Preferences: map[string]*notificationPreferences{
+		"someone": {Events: []string{eventDisabled}},
+	}})
+	if err = standby.Restore(ioutil.NopCloser(bytes.NewReader(snapshot))); err != nil {
+		t.Fatal(err)
+	}
+	if preferences, _ = getPreferences("swynter"); len(preferences.Events) != 0 {
+		t.Errorf("Expected a snapshot to replace everybody's preferences, got %+v", preferences)
+	}
+	if preferences, _ = getPreferences("someone"); len(preferences.Events) != 1 || preferences.Events[0] != eventDisabled {
+		t.Errorf("Expected the preferences from the snapshot, got %+v", preferences)
+	}
+}
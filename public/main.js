@@ -3,6 +3,7 @@
 
 	var interfaceTemplate = $('#interface_template > div.row');
 	var setheaderTemplate = $('#setheader_template > div.row');
+	var queueTemplate = $('#queue_template tr');
 
 	function ReqJSON(method, url, callback, data) {
 		var request = {
@@ -12,6 +13,12 @@
 				callback(data)
 			},
             error: function(jqXHR, textStatus) {
+                if(jqXHR.status==403)
+                	alert("Only admins can do that\nServer said:" + jqXHR.responseText)
+                if(jqXHR.status==503)
+                	alert("This zookeeper is on standby\nServer said:" + jqXHR.responseText)
+                if(jqXHR.status==400 || jqXHR.status==409)
+                	alert("Server said:" + jqXHR.responseText)
                 if(jqXHR.status==401)
                 	alert("Permission denied, please contact your team leader or someone in systems\nServer said:" + jqXHR.responseText)
                 if(jqXHR.status==500)
@@ -19,7 +26,7 @@
             },
 			dataType: 'json'
 		}
-		if (method == 'POST') {
+		if (method == 'POST' && data !== undefined) {
 			request.contentType = "application/json; charset=utf-8"
 			request.data = JSON.stringify(data);
 		}
@@ -34,10 +41,14 @@
 			.find('.ip')
 			.text(ip);
 		this.elm.find('.description').text(data.description);
+		this.elm.find('.discovered').toggle(data.discovered).attr('title', 'Discovered on ' + data.interface + ', it goes away when the address does');
 		interfaces.append(this.elm);
 		this.bssw = this.elm.find('input.switch').bootstrapSwitch().on('switchChange.bootstrapSwitch', function(event, state) {
 			this.setEnable(state);
 		}.bind(this));
+		this.elm.find('a.har').attr('href', '/proxy/' + ip + '/har')
+		this.elm.find('.description').on('click', this.describe.bind(this))
+		this.elm.find('button.remove-address').on('click', this.remove.bind(this))
 		this.ebtn = this.elm.find('button.extend').on('click', function() {
 			this.setEnable(true);
 		}.bind(this));
@@ -50,15 +61,64 @@
 	Interface.prototype.dataRefresh = function(data) {
 		this.data = data;
 
-		this.bssw.bootstrapSwitch('disabled', data.TargetURL === null ? true : false, true)
+		var mocking = data.Mode === "mock"
+		var fanningout = data.Mode === "fanout"
+		this.bssw.bootstrapSwitch('disabled', data.TargetURL === null && !mocking && !fanningout ? true : false, true)
 		this.bssw.bootstrapSwitch('state', data.Enabled, true);
 
+		var mode = "proxy"
+		if (mocking) {
+			mode = "mock responses (" + (data.Mocks || []).length + ")"
+		} else if (fanningout) {
+			mode = "fan out to " + (data.FanOut.Subscribers || []).join(", ")
+		}
+		this.elm.find('span.mode').text(mode)
+		var health = this.elm.find('span.health').removeClass('unknown healthy unhealthy')
+		if (!data.Enabled || data.Health === null) {
+			health.addClass('unknown').attr('title', 'Not checked')
+		} else if (data.Health.Healthy) {
+			health.addClass('healthy').attr('title', 'Reachable in ' + data.Health.Latency + ', checked ' + data.Health.Checked)
+		} else {
+			health.addClass('unhealthy').attr('title', data.Health.LastError + ', last reachable ' + data.Health.LastSuccess)
+		}
 		this.elm.find('span.targeturl').text(data.TargetURL === null ? "not forwarded" : data.TargetURL)
+		this.elm.find('span.shadows').text(data.Shadows === null || data.Shadows.length === 0 ? "nobody" : data.Shadows.join(", "))
 		this.elm.find('span.comment').text(data.Comment)
 		this.elm.find('span.who').text(data.TargetURL === null || data.Who === "" ? "nobody" : data.Who)
-		this.elm.find('span.expire').text(data.TargetURL === null || data.Expire === undefined || data.Expire === "" ? "never" : data.Expire)
+		if (data.Enabled || data.DisableReason === "") {
+			this.elm.find('span.expire').text(data.TargetURL === null || data.Expire === undefined || data.Expire === "" ? "never" : data.Expire)
+		} else {
+			this.elm.find('span.expire').text(data.DisableReason + " at " + data.Disabled)
+		}
+		var lastrequest = data.Activity.LastRequest.indexOf("0001-") === 0 ? "none yet" : data.Activity.LastRequest
+		if (data.IdleTimeout !== "") {
+			lastrequest += ", disabled after " + data.IdleTimeout + " idle"
+		}
+		this.elm.find('span.lastrequest').text(lastrequest)
+		var activity = data.Activity.Requests + " request(s) on " + data.Activity.Connections + " connection(s)"
+		if (data.Activity.Draining) {
+			activity += ", draining until " + data.Activity.DrainDeadline
+		}
+		this.elm.find('span.activity').text(activity)
+		var upcoming = (data.Upcoming || []).map(function(w) {
+			return w.Start + " to " + w.End + (w.Comment === "" ? "" : " (" + w.Comment + ")")
+		})
+		this.elm.find('span.upcoming').text(upcoming.length === 0 ? "nothing" : upcoming.join(", "))
+		if (data.Budget === null || data.Budget.Limit === 0) {
+			this.elm.find('span.budget').text("none")
+		} else {
+			var matching = (data.Budget.Method || "any") + " " + (data.Budget.Path || "request")
+			this.elm.find('span.budget').text(data.Activity.BudgetRemaining + " of " + data.Budget.Limit + " left, counting " + matching)
+		}
 		this.elm.find('span.maintainhost').text(data.MaintainHost ? "yes" : "no")
+		var activeFaults = (data.Faults || []).filter(function(f) { return f.Enabled }).length
+		this.elm.find('span.faults').text(activeFaults === 0 ? "none" : activeFaults + " active rule(s)")
+		this.elm.find('span.protocol').text(data.Protocol === "" ? "http/1.1" : data.Protocol)
 		this.elm.find('button.extend').toggle(data.Enabled)
+		this.elm.find('button.queue').toggle(data.Queue)
+		if (data.Queue) {
+			ReqJSON("GET", "/proxy/" + this.ip + "/queue", this.queueRefresh.bind(this))
+		}
 		var div = this.elm.find('div.setheaders').empty()
 		Object.keys(data.SetHeader).forEach(function(name) {
 			template = setheaderTemplate.clone(true)
@@ -68,6 +128,32 @@
 		}.bind(this))
 	}
 
+	Interface.prototype.queueRefresh = function(items) {
+		this.queue = items
+		this.elm.find('span.queued').text(items.length)
+		if (queueModal.data('iface') === this) {
+			var tbody = queueModal.find('tbody.items').empty()
+			items.forEach(function(item) {
+				var row = queueTemplate.clone()
+				row.find('td.received').text(item.Received)
+				row.find('td.request').text(item.Method + " " + item.URL)
+				row.find('td.attempts').text(item.Attempts + (item.Failed ? " (gave up)" : ""))
+				row.find('td.error').text(item.LastError || "")
+				row.find('button.redeliver').on('click', function() {
+					ReqJSON("POST", "/proxy/" + this.ip + "/queue/" + item.ID + "/redeliver", this.loadQueue.bind(this))
+				}.bind(this))
+				row.find('button.remove').on('click', function() {
+					ReqJSON("DELETE", "/proxy/" + this.ip + "/queue/" + item.ID, this.queueRefresh.bind(this))
+				}.bind(this))
+				tbody.append(row)
+			}.bind(this))
+		}
+	}
+
+	Interface.prototype.loadQueue = function() {
+		ReqJSON("GET", "/proxy/" + this.ip + "/queue", this.queueRefresh.bind(this))
+	}
+
 	Interface.prototype.post = function(target, data) {
 		path = "/proxy/" + this.ip;
 		if (typeof(target) === "string") {
@@ -78,7 +164,23 @@
 	};
 
 	Interface.prototype.setEnable = function(enable) {
-		this.post('enable', enable)
+		this.post('enable', {Enable: enable, TTL: this.elm.find('select.ttl').val()})
+	};
+
+	Interface.prototype.describe = function() {
+		var description = prompt("Description for " + this.ip, this.elm.find('.description').text())
+		if (description === null) return
+		ReqJSON("POST", "/interfaces/" + this.ip, function(data) {
+			this.elm.find('.description').text(data.description)
+			this.elm.find('.discovered').toggle(data.discovered)
+		}.bind(this), {description: description})
+	};
+
+	Interface.prototype.remove = function() {
+		if (!confirm("Stop listening on " + this.ip + "? Anything in flight gets a chance to finish")) return
+		ReqJSON("DELETE", "/interfaces/" + this.ip, function() {
+			this.elm.remove()
+		}.bind(this))
 	};
 
 	function addInterfaces(data) {
@@ -89,6 +191,59 @@
 
 	ReqJSON("GET", "/interfaces", addInterfaces)
 
+	jQuery.ajax({type: "GET", url: "/cluster", dataType: "json", success: function(status) {
+		var leading = status.State === "Leader"
+		var label = $('#cluster').show().find('span.label')
+			.toggleClass('label-success', leading)
+			.toggleClass('label-warning', !leading)
+			.text(status.NodeID + (leading ? " (leader)" : " (standby)"))
+		if (!leading && status.LeaderAdmin !== "") {
+			label.attr('title', 'Make changes on the leader, ' + status.LeaderAdmin)
+		}
+	}})
+
+	$('a.add-address').on('click', function(event) {
+		event.preventDefault()
+		var ip = prompt("Address to listen on")
+		if (ip === null || ip.trim() === "") return
+		var description = prompt("Description for " + ip.trim(), "")
+		ReqJSON("POST", "/interfaces", addInterfaces, {ip: ip.trim(), description: description || ""})
+	})
+
+	$('a.reload').on('click', function(event) {
+		event.preventDefault()
+		ReqJSON("POST", "/reload", function(report) {
+			var lines = []
+			var sections = {Added: "Added", Removed: "Removed", Described: "Described", Applied: "Applied", NeedsRestart: "Needs a restart", Errors: "Errors"}
+			Object.keys(sections).forEach(function(k) {
+				if (report[k] !== null && report[k].length > 0) {
+					lines.push(sections[k] + ": " + report[k].join(", "))
+				}
+			})
+			alert("Configuration reloaded\n" + (lines.length === 0 ? "Nothing changed" : lines.join("\n")))
+			interfaces.empty()
+			ReqJSON("GET", "/interfaces", addInterfaces)
+		})
+	})
+
+	var queueModal = $('#queueModal')
+	queueModal.on('show.bs.modal', function(event) {
+		var iface = $(event.relatedTarget).closest('div.row').data('obj')
+		queueModal.data('iface', iface)
+		queueModal.find('.modal-title').text('Queued requests for ' + iface.ip)
+		queueModal.find('.purge').off('click').on('click', function() {
+			if (confirm("Throw away every queued request for " + iface.ip + "?")) {
+				ReqJSON("DELETE", "/proxy/" + iface.ip + "/queue", iface.queueRefresh.bind(iface))
+			}
+		})
+		queueModal.find('.redeliver-all').off('click').on('click', function() {
+			ReqJSON("POST", "/proxy/" + iface.ip + "/queue/redeliver", iface.queueRefresh.bind(iface))
+		})
+		iface.loadQueue()
+	}).on('hidden.bs.modal', function() {
+		queueModal.removeData('iface')
+	})
+
 	$('#setupModal').on('show.bs.modal', function(event) {
 		var btn = $(event.relatedTarget)
 		var iface = btn.closest('div.row').data('obj')
@@ -96,14 +251,53 @@
 
 		modal.find('form')[0].reset()
 
+		var mode = modal.find('#Mode')
+		var mocks = modal.find('#Mocks')
+		var subscribers = modal.find('#Subscribers')
+		var primary = modal.find('#Primary')
 		var targeturl = modal.find('#TargetURL')
 		var comment = modal.find('#Comment')
+		var probepath = modal.find('#ProbePath')
+		var idletimeout = modal.find('#IdleTimeout')
+		var budgetlimit = modal.find('#BudgetLimit')
+		var budgetmethod = modal.find('#BudgetMethod')
+		var budgetpath = modal.find('#BudgetPath')
+		var shadows = modal.find('#Shadows')
+		var rewrites = modal.find('#Rewrites')
+		var headerrules = modal.find('#HeaderRules')
+		var schedule = modal.find('#Schedule')
 		var maintainhost = modal.find("#MaintainHost")[0]
+		var protocol = modal.find('#Protocol')
+		var record = modal.find('#Record')[0]
+		var queue = modal.find('#Queue')[0]
+		var flushinterval = modal.find('#FlushInterval')
+		var streamchunked = modal.find('#StreamChunked')[0]
+		var streamautodetect = modal.find('#StreamAutoDetect')[0]
 		var setheader = modal.find('#SetHeader')
 
+		mode.val(iface.data.Mode === "" ? "proxy" : iface.data.Mode)
+		mocks.val(iface.data.Mocks === null ? "" : JSON.stringify(iface.data.Mocks, null, 2))
+		subscribers.val((iface.data.FanOut.Subscribers || []).join("\n"))
+		primary.val(iface.data.FanOut.Primary)
 		targeturl.val(iface.data.TargetURL)
 		comment.val(iface.data.Comment)
+		probepath.val(iface.data.ProbePath)
+		idletimeout.val(iface.data.IdleTimeout)
+		var budget = iface.data.Budget || {Limit: 0, Method: "", Path: ""}
+		budgetlimit.val(budget.Limit === 0 ? "" : budget.Limit)
+		budgetmethod.val(budget.Method)
+		budgetpath.val(budget.Path)
+		headerrules.val(iface.data.HeaderRules === null ? "" : JSON.stringify(iface.data.HeaderRules, null, 2))
+		schedule.val(iface.data.Schedule === null ? "" : JSON.stringify(iface.data.Schedule, null, 2))
+		rewrites.val(iface.data.Rewrites === null ? "" : JSON.stringify(iface.data.Rewrites, null, 2))
+		shadows.val(iface.data.Shadows === null ? "" : iface.data.Shadows.join("\n"))
 		maintainhost.checked = iface.data.MaintainHost
+		protocol.val(iface.data.Protocol === "" ? "http/1.1" : iface.data.Protocol)
+		record.checked = iface.data.Record
+		queue.checked = iface.data.Queue
+		flushinterval.val(iface.data.Streaming.FlushInterval)
+		streamchunked.checked = iface.data.Streaming.Chunked
+		streamautodetect.checked = !iface.data.Streaming.NoAutoDetect
 		Object.keys(iface.data.SetHeader).sort().forEach(function (name) {
 			setheader.val(setheader.val() + name + ": " + iface.data.SetHeader[name] + "\n")
 		})
@@ -111,10 +305,75 @@
 
 		modal.find('.modal-title').text('Configuring ' + iface.ip)
 		modal.find('.btn-primary').off('click').on('click', function() {
+			var mockdata = []
+			if (mocks.val().trim() !== "") {
+				try {
+					mockdata = JSON.parse(mocks.val())
+				} catch (e) {
+					alert("Mock responses aren't valid JSON\n" + e)
+					return
+				}
+			}
+
+			var rewritedata = []
+			if (rewrites.val().trim() !== "") {
+				try {
+					rewritedata = JSON.parse(rewrites.val())
+				} catch (e) {
+					alert("Rewrite rules aren't valid JSON\n" + e)
+					return
+				}
+			}
+
+			var headerruledata = []
+			if (headerrules.val().trim() !== "") {
+				try {
+					headerruledata = JSON.parse(headerrules.val())
+				} catch (e) {
+					alert("Header rules aren't valid JSON\n" + e)
+					return
+				}
+			}
+
+			var scheduledata = []
+			if (schedule.val().trim() !== "") {
+				try {
+					scheduledata = JSON.parse(schedule.val())
+				} catch (e) {
+					alert("Scheduled windows aren't valid JSON\n" + e)
+					return
+				}
+			}
+
 			data = {
+				Mode: mode.val(),
+				Schedule: scheduledata,
+				Rewrites: rewritedata,
+				HeaderRules: headerruledata,
+				Mocks: mockdata,
+				FanOut: {
+					Subscribers: subscribers.val().split(/\r?\n/).map(function(s) { return s.trim() }).filter(function(s) { return s !== "" }),
+					Primary: primary.val().trim()
+				},
 				TargetURL: targeturl.val(),
 				Comment: comment.val(),
+				ProbePath: probepath.val(),
+				IdleTimeout: idletimeout.val(),
+				Budget: budgetlimit.val().trim() === "" ? null : {
+					Limit: parseInt(budgetlimit.val(), 10),
+					Method: budgetmethod.val().trim().toUpperCase(),
+					Path: budgetpath.val().trim()
+				},
+				Shadows: shadows.val().split(/\r?\n/).map(function(s) { return s.trim() }).filter(function(s) { return s !== "" }),
 				MaintainHost: maintainhost.checked,
+				Protocol: protocol.val(),
+				Record: record.checked,
+				Queue: queue.checked,
+				Streaming: {
+					FlushInterval: flushinterval.val(),
+					Chunked: streamchunked.checked,
+					NoAutoDetect: !streamautodetect.checked
+				},
 				SetHeader: {}
 			};
 
@@ -0,0 +1,393 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errQueueBodyTooLarge = errors.New("Request body too large to queue")
+	errQueueDelivering   = errors.New("Already being delivered")
+)
+
+type queueConfiguration struct {
+	Directory   string   `toml:"directory"`
+	MaxBody     int64    `toml:"max_body"`
+	RetryMin    duration `toml:"retry_min"`
+	RetryMax    duration `toml:"retry_max"`
+	MaxAttempts int      `toml:"max_attempts"`
+}
+
+type queuedRequest struct {
+	ID          string
+	Received    time.Time
+	ClientIP    string
+	Method      string
+	URL         string
+	Host        string
+	Header      http.Header
+	Body        []byte
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+	// Set once MaxAttempts is reached, it'll only be tried again by hand
+	Failed bool
+	// Somebody is trying it right now, not saved since nobody is after a restart
+	delivering bool
+}
+
+// deliveryQueue holds requests for an interface on disk until its target can take them
+type deliveryQueue struct {
+	sync.Mutex
+	ip    string
+	dir   string
+	items []*queuedRequest
+	kick  chan struct{}
+	done  chan struct{}
+}
+
+var queueSeq uint32
+
+func getQueue(ip string) *deliveryQueue {
+	if iface := manager.get(ip); iface != nil {
+		return iface.queue
+	}
+	return nil
+}
+
+// newDeliveryQueue loads anything left over from last time, run starts the redelivering
+func newDeliveryQueue(ip string) (*deliveryQueue, error) {
+	q := &deliveryQueue{
+		ip:   ip,
+		dir:  filepath.Join(config().Queue.Directory, ip),
+		kick: make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		item := &queuedRequest{}
+		content, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(content, item)
+		}
+		if err != nil {
+			log.Printf("\tUnable to load queued request %s: %s", file, err)
+			continue
+		}
+		q.items = append(q.items, item)
+	}
+	sort.Sort(queuedRequests(q.items))
+	if len(q.items) > 0 {
+		log.Printf("\t%d queued requests for %s", len(q.items), ip)
+	}
+
+	return q, nil
+}
+
+type queuedRequests []*queuedRequest
+
+func (q queuedRequests) Len() int           { return len(q) }
+func (q queuedRequests) Less(i, j int) bool { return q[i].Received.Before(q[j].Received) }
+func (q queuedRequests) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *deliveryQueue) enqueue(r *http.Request, body []byte) (*queuedRequest, error) {
+	if body == nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, config().Queue.MaxBody+1))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if int64(len(body)) > config().Queue.MaxBody {
+		return nil, errQueueBodyTooLarge
+	}
+
+	now := time.Now()
+	item := &queuedRequest{
+		ID:          fmt.Sprintf("%d-%d", now.UnixNano(), atomic.AddUint32(&queueSeq, 1)),
+		Received:    now,
+		ClientIP:    clientIP(r),
+		Method:      r.Method,
+		URL:         r.URL.RequestURI(),
+		Host:        r.Host,
+		Header:      r.Header.Clone(),
+		Body:        body,
+		NextAttempt: now,
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if err := q.save(item); err != nil {
+		return nil, err
+	}
+	q.items = append(q.items, item)
+	q.wake()
+	return item, nil
+}
+
+func (q *deliveryQueue) wake() {
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the item out via a temporary file so a crash can't leave half a request behind
+func (q *deliveryQueue) save(item *queuedRequest) error {
+	content, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(q.dir, item.ID+".json")
+	if err = ioutil.WriteFile(file+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+func (q *deliveryQueue) list() []queuedRequest {
+	q.Lock()
+	defer q.Unlock()
+	items := make([]queuedRequest, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, *item)
+	}
+	return items
+}
+
+func (q *deliveryQueue) find(id string) *queuedRequest {
+	for _, item := range q.items {
+		if item.ID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+func (q *deliveryQueue) remove(id string) bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.removeLocked(id)
+}
+
+func (q *deliveryQueue) removeLocked(id string) bool {
+	for i, item := range q.items {
+		if item.ID == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			if err := os.Remove(filepath.Join(q.dir, id+".json")); err != nil && !os.IsNotExist(err) {
+				log.Printf("[%s] Unable to remove queued request %s: %s", q.ip, id, err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (q *deliveryQueue) purge() int {
+	q.Lock()
+	defer q.Unlock()
+	count := len(q.items)
+	for len(q.items) > 0 {
+		q.removeLocked(q.items[0].ID)
+	}
+	return count
+}
+
+// ready is true when there's somewhere to deliver to
+func (q *deliveryQueue) ready() bool {
+	data := getData(q.ip)
+	return data.Enabled && (data.Mode == "" || data.Mode == modeProxy) && data.TargetURL.URL != nil
+}
+
+func (q *deliveryQueue) backoff(attempts int) time.Duration {
+	wait := config().Queue.RetryMin.Duration
+	for i := 1; i < attempts && wait < config().Queue.RetryMax.Duration; i++ {
+		wait *= 2
+	}
+	if wait > config().Queue.RetryMax.Duration {
+		wait = config().Queue.RetryMax.Duration
+	}
+	return wait
+}
+
+// start gets the redelivering going
+func (q *deliveryQueue) start() {
+	q.Lock()
+	defer q.Unlock()
+	if q.done == nil {
+		q.done = make(chan struct{})
+		go q.run(q.done)
+	}
+}
+
+func (q *deliveryQueue) run(done chan struct{}) {
+	for {
+		wait := q.deliverDue()
+		select {
+		case <-q.kick:
+		case <-time.After(wait):
+		case <-done:
+			return
+		}
+	}
+}
+
+// close stops the redelivering, anything queued stays on disk for if the interface comes back
+// or another process takes over
+func (q *deliveryQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	if q.done != nil {
+		close(q.done)
+		q.done = nil
+	}
+}
+
+// deliverDue works through everything due in order, giving up at the first failure since the
+// target is probably still unreachable. It returns how long until something is next due
+func (q *deliveryQueue) deliverDue() time.Duration {
+	wait := config().Queue.RetryMax.Duration
+	if !q.ready() {
+		return wait
+	}
+
+	for _, item := range q.list() {
+		if item.Failed || item.delivering {
+			continue
+		}
+		if due := item.NextAttempt.Sub(time.Now()); due > 0 {
+			if due < wait {
+				wait = due
+			}
+			continue
+		}
+		if _, err := q.redeliver(item.ID); err == errQueueDelivering {
+			continue
+		} else if err != nil {
+			return config().Queue.RetryMin.Duration
+		}
+	}
+	return wait
+}
+
+// redeliver makes an attempt at delivering the item right now, regardless of when it's due
+func (q *deliveryQueue) redeliver(id string) (*deliveryResult, error) {
+	data := getData(q.ip)
+	if data.TargetURL.URL == nil {
+		return nil, errors.New("Proxy has no target URL")
+	}
+
+	q.Lock()
+	item := q.find(id)
+	if item == nil {
+		q.Unlock()
+		return nil, os.ErrNotExist
+	}
+	// The background redelivery and the admin interface mustn't both send it
+	if item.delivering {
+		q.Unlock()
+		return nil, errQueueDelivering
+	}
+	item.delivering = true
+	copied := *item
+	q.Unlock()
+	defer func() {
+		q.Lock()
+		if item := q.find(id); item != nil {
+			item.delivering = false
+		}
+		q.Unlock()
+	}()
+
+	req, err := http.NewRequest(copied.Method, copied.URL, bytes.NewReader(copied.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = copied.Header.Clone()
+	req.Host = copied.Host
+	req.RemoteAddr = copied.ClientIP + ":0"
+	req.Header.Set("X-Zookeeper-Queued", copied.Received.Format(time.RFC3339))
+	req = withRequestID(req, copied.ID)
+	directRequest(q.ip, data, data.TargetURL.URL, req)
+
+	result := deliver(q.ip, data.TargetURL.String(), req, nil)
+	if result.Response.Error == "" && result.Response.Status < http.StatusInternalServerError {
+		log.Printf("[%s] delivered queued %s %s after %d attempts", q.ip, copied.Method, copied.URL, copied.Attempts+1)
+		q.remove(id)
+		return result, nil
+	}
+
+	err = errors.New(result.Response.Error)
+	if result.Response.Error == "" {
+		err = fmt.Errorf("Target answered %d", result.Response.Status)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if item = q.find(id); item != nil {
+		item.Attempts++
+		item.LastError = err.Error()
+		item.NextAttempt = time.Now().Add(q.backoff(item.Attempts))
+		item.Failed = config().Queue.MaxAttempts > 0 && item.Attempts >= config().Queue.MaxAttempts
+		if saveErr := q.save(item); saveErr != nil {
+			log.Printf("[%s] Unable to update queued request %s: %s", q.ip, id, saveErr)
+		}
+	}
+	return result, err
+}
+
+// queueRequest answers the caller once the request is safely on disk
+func queueRequest(ip string, q *deliveryQueue, w http.ResponseWriter, r *http.Request, body []byte) {
+	clientIP := clientIP(r)
+	item, err := q.enqueue(r, body)
+	switch {
+	case err == errQueueBodyTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case err != nil:
+		log.Printf("[%s] %s %s %s unable to queue: %s", ip, clientIP, r.Host, r.URL.String(), err)
+		http.Error(w, "Unable to queue request", http.StatusInternalServerError)
+	default:
+		log.Printf("[%s] %s %s %s queued as %s", ip, clientIP, r.Host, r.URL.String(), item.ID)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "Queued for delivery")
+	}
+}
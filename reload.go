@@ -0,0 +1,222 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// reloadReport is what a reload changed
+type reloadReport struct {
+	Added     []string
+	Removed   []string
+	Described []string
+	// Settings that took effect straight away
+	Applied []string
+	// Settings that changed but won't take effect until a restart
+	NeedsRestart []string
+	Errors       []string
+}
+
+func (r *reloadReport) log() {
+	log.Println("Configuration reloaded")
+	for _, line := range []struct {
+		name  string
+		items []string
+	}{
+		{"Added", r.Added},
+		{"Removed", r.Removed},
+		{"Described", r.Described},
+		{"Applied", r.Applied},
+		{"Needs a restart", r.NeedsRestart},
+		{"Errors", r.Errors},
+	} {
+		if len(line.items) > 0 {
+			log.Printf("\t%s: %s", line.name, strings.Join(line.items, ", "))
+		}
+	}
+}
+
+// Only one reload at a time
+var reloadMutex sync.Mutex
+
+// reloadConfiguration reads the configuration file again and applies whatever changed, proxies
+// on addresses that are still there are left alone
+func reloadConfiguration() (*reloadReport, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	current := config()
+	log.Println("Reloading configuration file", current.file)
+	next, err := loadConfiguration(current.file)
+	if err != nil {
+		return nil, err
+	}
+	report := &reloadReport{}
+	// Settings that are only read at startup stay as they are until a restart, serving a new
+	// address with a different disable_http2 to what the listeners negotiate would break h2
+	for _, setting := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"listen", current.Listen, next.Listen},
+		{"tls.disable_http2", current.TLS.DisableHTTP2, next.TLS.DisableHTTP2},
+		{"statesaver", current.StateSaver, next.StateSaver},
+		{"queue.directory", current.Queue.Directory, next.Queue.Directory},
+		{"cluster", current.Cluster, next.Cluster},
+	} {
+		if !reflect.DeepEqual(setting.old, setting.new) {
+			report.NeedsRestart = append(report.NeedsRestart, setting.name)
+		}
+	}
+	next.Listen = current.Listen
+	next.TLS.DisableHTTP2 = current.TLS.DisableHTTP2
+	next.StateSaver = current.StateSaver
+	next.Queue.Directory = current.Queue.Directory
+	next.Cluster = current.Cluster
+
+	for _, setting := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"tls.certificate", []byte(current.TLS.Certificate), []byte(next.TLS.Certificate)},
+		{"tls.key", []byte(current.TLS.Key), []byte(next.TLS.Key)},
+		{"queue", current.Queue, next.Queue},
+		{"max_ttl", current.MaxTTL, next.MaxTTL},
+		{"ttl", current.TTL, next.TTL},
+		{"drain_timeout", current.DrainTimeout, next.DrainTimeout},
+		{"admins", current.Admins, next.Admins},
+		{"addresses_file", current.AddressesFile, next.AddressesFile},
+		{"traffic", current.Traffic, next.Traffic},
+		{"healthcheck", current.HealthCheck, next.HealthCheck},
+		{"discovery", current.Discovery, next.Discovery},
+		{"notifications", current.Notifications, next.Notifications},
+	} {
+		if !reflect.DeepEqual(setting.old, setting.new) {
+			report.Applied = append(report.Applied, setting.name)
+		}
+	}
+
+	// Get everything that can fail out of the way before anything is changed
+	var certificate *tls.Certificate
+	if !reflect.DeepEqual(current.TLS, next.TLS) {
+		cer, err := tls.X509KeyPair(next.TLS.Certificate, next.TLS.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load certificate: %s", err)
+		}
+		certificate = &cer
+	}
+
+	var security *adminSecurity
+	if authenticationChanged(current, next) {
+		if security, err = newAdminSecurity(next); err != nil {
+			return nil, fmt.Errorf("Unable to configure authentication: %s", err)
+		}
+		report.Applied = append(report.Applied, "authentication", "accesscontrol")
+	}
+
+	var notifiers []NotificationInterface
+	if !reflect.DeepEqual(current.raw["notifier"], next.raw["notifier"]) {
+		if notifiers, err = newNotifiers(next); err != nil {
+			return nil, fmt.Errorf("Unable to configure notifications: %s", err)
+		}
+		report.Applied = append(report.Applied, "notifier")
+	}
+
+	setConfig(next)
+	if certificate != nil {
+		proxyCertificate.Store(certificate)
+	}
+	if security != nil {
+		currentSecurity.Store(security)
+	}
+	if notifiers != nil {
+		currentNotifiers.Store(notifiers)
+	}
+
+	running := manager.addresses()
+	for ip, address := range next.Addresses {
+		was, ok := running[ip]
+		switch {
+		case !ok:
+			iface, err := manager.bind(ip, address)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", ip, err))
+				continue
+			}
+			iface.serve()
+			report.Added = append(report.Added, ip)
+		case was != address:
+			manager.describe(ip, address)
+			report.Described = append(report.Described, ip)
+		}
+	}
+	for ip, address := range running {
+		// Discovery looks after its own
+		if _, ok := next.Addresses[ip]; !ok && !address.Discovered {
+			if err := manager.remove(ip); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", ip, err))
+				continue
+			}
+			report.Removed = append(report.Removed, ip)
+		}
+	}
+	sort.Strings(report.Added)
+	sort.Strings(report.Removed)
+	sort.Strings(report.Described)
+
+	report.log()
+	return report, nil
+}
+
+// authenticationChanged compares the methods and their module configuration as the file has it,
+// the modules only decode their own sections when they're initialized
+func authenticationChanged(current, next *configuration) bool {
+	if current.AuthenticationMethod != next.AuthenticationMethod || current.AccessControlMethod != next.AccessControlMethod {
+		return true
+	}
+	for _, section := range []string{"authentication", "accesscontrol"} {
+		if !reflect.DeepEqual(current.raw[section], next.raw[section]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadOnSignal reloads on SIGHUP
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if _, err := reloadConfiguration(); err != nil {
+			log.Println("Unable to reload configuration:", err)
+		}
+	}
+}
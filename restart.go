@@ -0,0 +1,237 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/tylerb/graceful"
+)
+
+const (
+	// Name given to the admin interface's listener when handing over, systemd sockets should use
+	// FileDescriptorName=admin for it too
+	adminListenerName = "admin"
+
+	// Inherited descriptors start after stdin, stdout and stderr
+	listenFDsStart = 3
+
+	handOffFDsEnv   = "ZOOKEEPER_LISTEN_FDS"
+	handOffNamesEnv = "ZOOKEEPER_LISTEN_FDNAMES"
+)
+
+// Listeners from systemd or the process that handed over, by address or adminListenerName. They're
+// taken out as they're used
+var (
+	inheritedMutex sync.Mutex
+	inherited      = map[string]*net.TCPListener{}
+)
+
+// Set once a new process has taken over, the state belongs to it from then on
+var handedOff int32
+
+// inheritListeners picks up listeners from systemd socket activation or a handover
+func inheritListeners() error {
+	count, names := 0, ""
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		count, _ = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names = os.Getenv("LISTEN_FDNAMES")
+		log.Println("\tSocket activated with", count, "listeners")
+	} else if fds := os.Getenv(handOffFDsEnv); fds != "" {
+		count, _ = strconv.Atoi(fds)
+		names = os.Getenv(handOffNamesEnv)
+		log.Println("\tTaking over", count, "listeners")
+	}
+	// Nothing we start should think they're meant for it
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", handOffFDsEnv, handOffNamesEnv} {
+		os.Unsetenv(env)
+	}
+
+	split := strings.Split(names, ":")
+	inheritedMutex.Lock()
+	defer inheritedMutex.Unlock()
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(listenFDsStart+i), "listener")
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to use inherited listener %d: %s", i, err)
+		}
+		tcp, ok := listener.(*net.TCPListener)
+		if !ok {
+			listener.Close()
+			return fmt.Errorf("Inherited listener %d isn't TCP", i)
+		}
+
+		// Anything that isn't named after what it's for goes by the address it's listening on
+		name := ""
+		if i < len(split) {
+			name = split[i]
+		}
+		if name != adminListenerName && net.ParseIP(name) == nil {
+			name = tcp.Addr().(*net.TCPAddr).IP.String()
+		}
+		log.Println("\tInherited", name, tcp.Addr())
+		inherited[name] = tcp
+	}
+	return nil
+}
+
+// listenTCP uses the inherited listener for name if there is one, otherwise it listens on address
+func listenTCP(name, address string) (*net.TCPListener, error) {
+	inheritedMutex.Lock()
+	listener, ok := inherited[name]
+	delete(inherited, name)
+	inheritedMutex.Unlock()
+	if ok {
+		return listener, nil
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// closeInherited closes inherited listeners nothing wanted, addresses that have since gone
+// from the configuration say
+func closeInherited() {
+	inheritedMutex.Lock()
+	defer inheritedMutex.Unlock()
+	for name, listener := range inherited {
+		log.Println("\tClosing unused inherited listener", name, listener.Addr())
+		listener.Close()
+		delete(inherited, name)
+	}
+}
+
+// handOff starts a new copy of zookeeper with every listener, the state has to be saved first
+func handOff(admin *net.TCPListener) (*os.Process, error) {
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	names := []string{}
+	defer func() {
+		for _, file := range files[listenFDsStart:] {
+			file.Close()
+		}
+	}()
+
+	add := func(name string, listener *net.TCPListener) error {
+		file, err := listener.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		names = append(names, name)
+		return nil
+	}
+	if err := add(adminListenerName, admin); err != nil {
+		return nil, err
+	}
+	for _, ip := range manager.ips() {
+		if iface := manager.get(ip); iface != nil {
+			if listener := iface.tcpListener(); listener != nil {
+				if err := add(ip, listener); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	env := append(os.Environ(),
+		handOffFDsEnv+"="+strconv.Itoa(len(names)),
+		handOffNamesEnv+"="+strings.Join(names, ":"),
+	)
+	return os.StartProcess(executable, os.Args, &os.ProcAttr{Env: env, Files: files})
+}
+
+// restartOnSignal hands over to a new process on SIGUSR2 and then stops the admin interface,
+// which has main drain and exit without saving the state
+func restartOnSignal(admin *graceful.Server, listener *net.TCPListener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	for range signals {
+		if cluster != nil {
+			log.Println("Not handing over, a cluster member can't share its raft address. Restart it and let the cluster fail over instead")
+			continue
+		}
+		log.Println("Handing over to a new process")
+		if stateSaving {
+			if err := saveState(); err != nil {
+				log.Println("Not handing over, unable to save state:", err)
+				continue
+			}
+		}
+
+		// The new process redelivers from here on
+		queues := []*deliveryQueue{}
+		for _, ip := range manager.ips() {
+			if q := getQueue(ip); q != nil {
+				q.close()
+				queues = append(queues, q)
+			}
+		}
+
+		process, err := handOff(listener)
+		if err != nil {
+			log.Println("Unable to hand over:", err)
+			for _, q := range queues {
+				q.start()
+			}
+			continue
+		}
+
+		log.Println("Handed over to", process.Pid)
+		atomic.StoreInt32(&handedOff, 1)
+		process.Release()
+		admin.Stop(admin.Timeout)
+		return
+	}
+}
+
+// notifySystemd tells systemd how things are going, if it's listening. With Type=notify and
+// NotifyAccess=all this is how it finds out a new process has taken over
+func notifySystemd(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Println("Unable to notify systemd:", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
@@ -0,0 +1,105 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type rewriteRule struct {
+	// Regular expression matched against the path, the rule is skipped if it doesn't match
+	Match string
+	// Replaces the matched part of the path, $1 style capture groups are expanded
+	Replace string
+	// Regular expression matched against the raw query, replaced with QueryReplace
+	Query        string
+	QueryReplace string
+	// Taken off the front of the path
+	StripPrefix string
+	// Query parameters to set, replacing any already there
+	SetQuery url.Values
+	// Query parameters to remove
+	RemoveQuery []string
+	// Stop once this rule has been applied
+	Last bool
+
+	matchRegexp *regexp.Regexp
+	queryRegexp *regexp.Regexp
+}
+
+func compileRewrites(rules []*rewriteRule) (err error) {
+	for i, rule := range rules {
+		if rule == nil {
+			return fmt.Errorf("Rewrite rule %d is empty", i+1)
+		}
+		if rule.matchRegexp, err = regexp.Compile(rule.Match); err != nil {
+			return fmt.Errorf("Unable to compile rewrite match %q: %s", rule.Match, err)
+		}
+		if rule.queryRegexp, err = regexp.Compile(rule.Query); err != nil {
+			return fmt.Errorf("Unable to compile rewrite query %q: %s", rule.Query, err)
+		}
+	}
+	return nil
+}
+
+// rewriteURL applies the rules in order to the path and query of u, returning which rules applied
+func rewriteURL(rules []*rewriteRule, u *url.URL) (applied []int) {
+	for i, rule := range rules {
+		if rule.matchRegexp == nil || !rule.matchRegexp.MatchString(u.Path) {
+			continue
+		}
+		applied = append(applied, i)
+
+		if rule.Match != "" && rule.Replace != "" {
+			u.Path = rule.matchRegexp.ReplaceAllString(u.Path, rule.Replace)
+		}
+		if rule.StripPrefix != "" && strings.HasPrefix(u.Path, rule.StripPrefix) {
+			u.Path = u.Path[len(rule.StripPrefix):]
+		}
+		if !strings.HasPrefix(u.Path, "/") {
+			u.Path = "/" + u.Path
+		}
+		// Let the path be rebuilt from Path rather than some stale escaped version
+		u.RawPath = ""
+
+		if rule.Query != "" {
+			u.RawQuery = rule.queryRegexp.ReplaceAllString(u.RawQuery, rule.QueryReplace)
+		}
+		if len(rule.SetQuery) > 0 || len(rule.RemoveQuery) > 0 {
+			query := u.Query()
+			for _, name := range rule.RemoveQuery {
+				query.Del(name)
+			}
+			for name, values := range rule.SetQuery {
+				query[name] = values
+			}
+			u.RawQuery = query.Encode()
+		}
+
+		if rule.Last {
+			break
+		}
+	}
+	return
+}
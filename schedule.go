@@ -0,0 +1,215 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Who scheduled enables are done by
+const scheduleWho = "schedule"
+
+// scheduleWindow is when a proxy should be enabled, either once from Start to End or every time
+// Cron matches in TimeZone for Duration
+type scheduleWindow struct {
+	Start    time.Time
+	End      time.Time
+	Cron     string
+	TimeZone string
+	Duration duration
+	Comment  string
+
+	cron     *cronSchedule
+	location *time.Location
+}
+
+// scheduledWindow is one occurrence of a window
+type scheduledWindow struct {
+	Start   time.Time
+	End     time.Time
+	Comment string
+}
+
+func compileSchedule(schedule []*scheduleWindow) error {
+	for i, window := range schedule {
+		if window.Cron == "" {
+			if window.Start.IsZero() || !window.End.After(window.Start) {
+				return fmt.Errorf("Window %d needs a Start and an End after it, or a Cron", i)
+			}
+			continue
+		}
+
+		var err error
+		if window.cron, err = parseCron(window.Cron); err != nil {
+			return fmt.Errorf("Window %d: %s", i, err)
+		}
+		if window.Duration.Duration <= 0 {
+			return fmt.Errorf("Window %d needs a Duration", i)
+		}
+		window.location = time.Local
+		if window.TimeZone != "" {
+			if window.location, err = time.LoadLocation(window.TimeZone); err != nil {
+				return fmt.Errorf("Window %d: %s", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// next is the first occurrence that hasn't ended by t, it may already have started
+func (w *scheduleWindow) next(t time.Time) (scheduledWindow, bool) {
+	if w.cron == nil {
+		return scheduledWindow{w.Start, w.End, w.Comment}, w.End.After(t)
+	}
+	// Anything that started within Duration of t is still going
+	start := w.cron.next(t.Add(-w.Duration.Duration).In(w.location))
+	if start.IsZero() {
+		return scheduledWindow{}, false
+	}
+	return scheduledWindow{start, start.Add(w.Duration.Duration), w.Comment}, true
+}
+
+// upcoming is the next count occurrences across every window that haven't ended by t, soonest first
+func upcoming(schedule []*scheduleWindow, t time.Time, count int) []scheduledWindow {
+	windows := []scheduledWindow{}
+	for _, window := range schedule {
+		from := t
+		for i := 0; i < count; i++ {
+			occurrence, ok := window.next(from)
+			if !ok {
+				break
+			}
+			windows = append(windows, occurrence)
+			if window.cron == nil {
+				break
+			}
+			from = occurrence.End
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Start.Before(windows[j].Start)
+	})
+	if len(windows) > count {
+		windows = windows[:count]
+	}
+	return windows
+}
+
+// scheduler enables the proxy when a window starts, with the window's end as the expiry so it's
+// taken down the same way as any other. A window is only acted on once, disabling a proxy during
+// one keeps it down
+func (i *proxyInterface) scheduler(done chan struct{}) {
+	var handled time.Time
+	for {
+		wait := time.Hour
+		if !cluster.standby() {
+			now := time.Now()
+			if windows := upcoming(i.data().Schedule, now, 1); len(windows) > 0 {
+				window := windows[0]
+				if window.Start.After(now) {
+					wait = window.Start.Sub(now)
+				} else if !window.Start.Equal(handled) {
+					handled = window.Start
+					if err := i.enableScheduled(window); err != nil {
+						log.Printf("[%s] Unable to enable for scheduled window: %s", i.ip, err)
+					}
+					continue
+				} else {
+					wait = window.End.Sub(now)
+				}
+			}
+		}
+		if wait > time.Hour {
+			// The clock might be changed, and cluster members might take charge
+			wait = time.Hour
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-i.rescheduled:
+		case <-done:
+			return
+		}
+	}
+}
+
+// enableScheduled enables until the end of the window, or for as long as the ttl limits allow
+// if that's sooner. Windows are held to the same limits as anybody else
+func (i *proxyInterface) enableScheduled(window scheduledWindow) error {
+	data := i.data()
+	who := scheduleWho
+	if data.Enabled {
+		who = data.Who
+	}
+	expire, clamped, err := (&enableRequest{Enable: true, Until: window.End}).expiry(i.ip, who, time.Now())
+	if err != nil {
+		return err
+	}
+	if data.Enabled && !data.Expire.Before(expire) {
+		return nil
+	}
+	if data.Mode != modeMock && data.Mode != modeFanOut && data.TargetURL.URL == nil {
+		return errors.New("Proxy has no target URL")
+	}
+
+	if clamped {
+		log.Printf("[%s] Scheduled window %q is longer than allowed, enabling until %s instead of %s", i.ip, window.Comment, expire, window.End)
+	} else {
+		log.Printf("[%s] Enabling until %s for scheduled window %q", i.ip, expire, window.Comment)
+	}
+	event := eventExtended
+	if !data.Enabled {
+		event = eventEnabled
+	}
+	_, err = i.update(func(data *proxyData) error {
+		data.Expire = expire
+		if !data.Enabled {
+			data.Who = scheduleWho
+			data.WhoMail = ""
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if data, err = i.enable(); err != nil {
+		return err
+	}
+	e := newNotification(event, i.ip, data)
+	e.Reason = "Scheduled"
+	if window.Comment != "" {
+		e.Reason += ": " + window.Comment
+	}
+	notify(e)
+	return nil
+}
+
+// reschedule has the scheduler take another look
+func (i *proxyInterface) reschedule() {
+	select {
+	case i.rescheduled <- struct{}{}:
+	default:
+	}
+}
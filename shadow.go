@@ -0,0 +1,76 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serveShadowed sends the request to the primary as normal and a copy to every shadow target,
+// the exchange is recorded once all of them have answered
+func serveShadowed(ip string, data *proxyData, proxy http.Handler, w http.ResponseWriter, r *http.Request) {
+	body, ok, err := readCopyableBody(r)
+	if err != nil {
+		http.Error(w, "Unable to read request", http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		log.Printf("[%s] %s %s %s too large to shadow", ip, clientIP(r), r.Host, r.URL.String())
+		proxy.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	record := &trafficRecord{
+		Started:  start,
+		ClientIP: clientIP(r),
+		Request:  captureRequest(r, body),
+		Shadows:  make([]*deliveryResult, len(data.Shadows)),
+	}
+
+	// Build every shadow request before the primary director gets its hands on r
+	var wg sync.WaitGroup
+	for i, target := range data.Shadows {
+		req, err := copyRequest(ip, data, target, r, body)
+		if err != nil {
+			record.Shadows[i] = &deliveryResult{Target: target.String(), Response: capturedResponse{Error: err.Error()}}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, target string, req *http.Request) {
+			defer wg.Done()
+			record.Shadows[i] = deliver(ip, target, req, nil)
+		}(i, target.String(), req)
+	}
+
+	capture := newCaptureWriter(w)
+	proxy.ServeHTTP(capture, r)
+	record.Response = capture.response(start)
+
+	go func() {
+		wg.Wait()
+		getTrafficLog(ip).add(record)
+	}()
+}
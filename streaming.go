@@ -0,0 +1,89 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"mime"
+	"net/http"
+)
+
+// Content types that are useless unless every write makes it to the caller straight away
+var streamingContentTypes = map[string]bool{
+	"text/event-stream":         true,
+	"application/grpc":          true,
+	"application/x-ndjson":      true,
+	"multipart/x-mixed-replace": true,
+}
+
+type streamingData struct {
+	// Flush whatever has been buffered at this interval, 0 leaves it to the buffer filling up
+	FlushInterval duration
+	// Flush every write of responses with no Content-Length, ie chunked responses
+	Chunked bool
+	// Don't flush every write of the streamingContentTypes
+	NoAutoDetect bool
+}
+
+// streamingWriter flushes after every write once the response headers show it's a stream
+type streamingWriter struct {
+	wrappedWriter
+	settings  streamingData
+	immediate bool
+}
+
+func newStreamingWriter(w http.ResponseWriter, settings streamingData) http.ResponseWriter {
+	if _, ok := w.(http.Flusher); !ok {
+		return w
+	}
+	return &streamingWriter{wrappedWriter: wrappedWriter{w}, settings: settings}
+}
+
+func (s *streamingWriter) isStream() bool {
+	header := s.ResponseWriter.Header()
+	if s.settings.Chunked && header.Get("Content-Length") == "" {
+		return true
+	}
+	if s.settings.NoAutoDetect {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return streamingContentTypes[mediaType]
+}
+
+func (s *streamingWriter) WriteHeader(code int) {
+	s.immediate = s.isStream()
+	s.ResponseWriter.WriteHeader(code)
+	if s.immediate {
+		// Get the headers out so the caller knows the stream has started
+		s.Flush()
+	}
+}
+
+func (s *streamingWriter) Write(b []byte) (n int, err error) {
+	n, err = s.ResponseWriter.Write(b)
+	if err == nil && s.immediate {
+		s.Flush()
+	}
+	return
+}
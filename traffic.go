@@ -0,0 +1,235 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type capturedRequest struct {
+	Method        string
+	URL           string
+	Proto         string
+	Header        http.Header
+	Body          string
+	BodyTruncated bool
+}
+
+type capturedResponse struct {
+	Status        int
+	Header        http.Header
+	Body          string
+	BodyTruncated bool
+	// Time until the response headers were ready, and until the whole thing was done
+	Wait     duration
+	Duration duration
+	Error    string `json:",omitempty"`
+}
+
+type trafficRecord struct {
+	ID         int64
+	Started    time.Time
+	ClientIP   string
+	Request    capturedRequest
+	Response   capturedResponse
+	Shadows    []*deliveryResult `json:",omitempty"`
+	Deliveries []*deliveryResult `json:",omitempty"`
+}
+
+// trafficLog keeps the last config.Traffic.History records for an interface
+type trafficLog struct {
+	sync.Mutex
+	nextID  int64
+	records []*trafficRecord
+}
+
+var (
+	trafficLogs      = map[string]*trafficLog{}
+	trafficLogsMutex sync.Mutex
+)
+
+func getTrafficLog(ip string) *trafficLog {
+	trafficLogsMutex.Lock()
+	defer trafficLogsMutex.Unlock()
+	traffic, ok := trafficLogs[ip]
+	if !ok {
+		traffic = &trafficLog{}
+		trafficLogs[ip] = traffic
+	}
+	return traffic
+}
+
+func (t *trafficLog) add(record *trafficRecord) {
+	t.Lock()
+	defer t.Unlock()
+	t.nextID++
+	record.ID = t.nextID
+	t.records = append(t.records, record)
+	if excess := len(t.records) - config().Traffic.History; excess > 0 {
+		t.records = append([]*trafficRecord{}, t.records[excess:]...)
+	}
+}
+
+func (t *trafficLog) list() []*trafficRecord {
+	t.Lock()
+	defer t.Unlock()
+	return append([]*trafficRecord{}, t.records...)
+}
+
+func (t *trafficLog) get(id int64) *trafficRecord {
+	t.Lock()
+	defer t.Unlock()
+	for _, record := range t.records {
+		if record.ID == id {
+			return record
+		}
+	}
+	return nil
+}
+
+func truncateBody(body []byte) (string, bool) {
+	// Read the limit once, a reload can lower it while we're here
+	if limit := config().Traffic.BodyLimit; len(body) > limit {
+		return string(body[:limit]), true
+	}
+	return string(body), false
+}
+
+func captureRequest(r *http.Request, body []byte) capturedRequest {
+	// Inbound requests only have a path, everything arrives over TLS
+	u := *r.URL
+	if u.Host == "" {
+		u.Scheme = "https"
+		u.Host = r.Host
+	}
+	captured := capturedRequest{
+		Method: r.Method,
+		URL:    u.String(),
+		Proto:  r.Proto,
+		Header: r.Header.Clone(),
+	}
+	captured.Body, captured.BodyTruncated = truncateBody(body)
+	return captured
+}
+
+// captureWriter keeps a copy of the response on its way through to the caller
+type captureWriter struct {
+	wrappedWriter
+	status    int
+	header    http.Header
+	headerAt  time.Time
+	body      bytes.Buffer
+	truncated bool
+}
+
+func newCaptureWriter(w http.ResponseWriter) *captureWriter {
+	return &captureWriter{wrappedWriter: wrappedWriter{w}}
+}
+
+func (c *captureWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+		c.header = c.ResponseWriter.Header().Clone()
+		c.headerAt = time.Now()
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if room := config().Traffic.BodyLimit - c.body.Len(); room > 0 {
+		if len(b) > room {
+			c.body.Write(b[:room])
+			c.truncated = true
+		} else {
+			c.body.Write(b)
+		}
+	} else if len(b) > 0 {
+		c.truncated = true
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *captureWriter) response(start time.Time) capturedResponse {
+	response := capturedResponse{
+		Status:        c.status,
+		Header:        c.header,
+		Body:          c.body.String(),
+		BodyTruncated: c.truncated,
+		Duration:      duration{time.Since(start)},
+	}
+	if !c.headerAt.IsZero() {
+		response.Wait = duration{c.headerAt.Sub(start)}
+	}
+	return response
+}
+
+// captureBody keeps the start of a request body as it's read by whoever is handling the request
+type captureBody struct {
+	io.ReadCloser
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (c *captureBody) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	if room := config().Traffic.BodyLimit - c.body.Len(); room > 0 {
+		if n > room {
+			c.body.Write(b[:room])
+			c.truncated = true
+		} else {
+			c.body.Write(b[:n])
+		}
+	} else if n > 0 {
+		// The limit can be lowered by a reload mid request
+		c.truncated = true
+	}
+	return n, err
+}
+
+// serveRecorded hands the request on to next, recording the exchange if the proxy asks for it
+func serveRecorded(ip string, data *proxyData, w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !data.Record {
+		next(w, r)
+		return
+	}
+
+	start := time.Now()
+	record := &trafficRecord{
+		Started:  start,
+		ClientIP: clientIP(r),
+		Request:  captureRequest(r, nil),
+	}
+	body := &captureBody{ReadCloser: r.Body}
+	r.Body = body
+
+	capture := newCaptureWriter(w)
+	next(capture, r)
+	record.Response = capture.response(start)
+	record.Request.Body, record.Request.BodyTruncated = body.body.String(), body.truncated
+	getTrafficLog(ip).add(record)
+}
@@ -0,0 +1,71 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	protocolHTTP1 = "http/1.1"
+	protocolHTTP2 = "h2"
+	protocolH2C   = "h2c"
+)
+
+// Shared between every proxy so connections to the same target get pooled
+var (
+	http1Transport = http.DefaultTransport
+	http2Transport = &http2.Transport{}
+	h2cTransport   = &http2.Transport{
+		// h2c is plain text http2, so skip the TLS dance entirely
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+)
+
+func validProtocol(protocol string) bool {
+	switch protocol {
+	case "", protocolHTTP1, protocolHTTP2, protocolH2C:
+		return true
+	}
+	return false
+}
+
+type proxyTransport string
+
+// RoundTrip picks the transport on every request so changing the protocol on an enabled
+// proxy takes effect without having to disable/enable it
+func (ip proxyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	switch getData(string(ip)).Protocol {
+	case protocolHTTP2:
+		return http2Transport.RoundTrip(r)
+	case protocolH2C:
+		// The target URL will say http, the http2 transport only cares that AllowHTTP is set
+		return h2cTransport.RoundTrip(r)
+	}
+	return http1Transport.RoundTrip(r)
+}
@@ -0,0 +1,104 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type ttlConfiguration struct {
+	// How long a proxy is enabled for when the caller doesn't say, max_ttl when it's not set
+	Default duration `toml:"default"`
+	// Limits tighter than max_ttl for particular users and interfaces
+	Users      map[string]duration `toml:"users"`
+	Interfaces map[string]duration `toml:"interfaces"`
+}
+
+// enableRequest is what /proxy/:ip/enable takes, a plain true or false or, to say for how long,
+// an object with either a TTL from now or a time to stay up Until
+type enableRequest struct {
+	Enable bool
+	TTL    duration
+	Until  time.Time
+}
+
+func (e *enableRequest) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &e.Enable); err == nil {
+		return nil
+	}
+	// Saying for how long is asking for it to be enabled, anything else has to say which
+	object := struct {
+		Enable *bool
+		TTL    duration
+		Until  time.Time
+	}{}
+	if err := json.Unmarshal(b, &object); err != nil {
+		return err
+	}
+	e.TTL, e.Until = object.TTL, object.Until
+	switch {
+	case object.Enable != nil:
+		e.Enable = *object.Enable
+	case object.TTL.Duration != 0 || !object.Until.IsZero():
+		e.Enable = true
+	default:
+		return errors.New("Enable, TTL or Until has to be given")
+	}
+	return nil
+}
+
+// ttlLimit is the longest user can have ip enabled for
+func ttlLimit(ip, user string) time.Duration {
+	c := config()
+	limit := c.MaxTTL.Duration
+	for _, l := range []duration{c.TTL.Users[user], c.TTL.Interfaces[ip]} {
+		if l.Duration > 0 && l.Duration < limit {
+			limit = l.Duration
+		}
+	}
+	return limit
+}
+
+// expiry works out when the proxy should go down, what was asked for cut down to the limit.
+// It returns whether it had to be cut down
+func (e *enableRequest) expiry(ip, user string, now time.Time) (time.Time, bool, error) {
+	limit := ttlLimit(ip, user)
+
+	ttl := config().TTL.Default.Duration
+	switch {
+	case e.TTL.Duration != 0:
+		ttl = e.TTL.Duration
+	case !e.Until.IsZero():
+		ttl = e.Until.Sub(now)
+	case ttl == 0:
+		ttl = limit
+	}
+	if ttl <= 0 {
+		return time.Time{}, false, errors.New("Expiry has to be in the future")
+	}
+
+	if ttl > limit {
+		return now.Add(limit), true, nil
+	}
+	return now.Add(ttl), false, nil
+}
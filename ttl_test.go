@@ -0,0 +1,122 @@
+/*
+ *   Zookeeper - Multi-interface proxy for those times when developers need public IPs
+ *   Copyright (c) 2015 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEnableRequest(t *testing.T) {
+	tests := []struct {
+		body   string
+		enable bool
+		ttl    time.Duration
+		fails  bool
+	}{
+		{body: `true`, enable: true},
+		{body: `false`},
+		{body: `{"Enable": true, "TTL": "20m"}`, enable: true, ttl: 20 * time.Minute},
+		{body: `{"Enable": false, "TTL": "20m"}`, ttl: 20 * time.Minute},
+		// Saying for how long is enough
+		{body: `{"TTL": "20m"}`, enable: true, ttl: 20 * time.Minute},
+		{body: `{"Until": "2016-01-12T17:30:00+11:00"}`, enable: true},
+		// Nothing at all isn't taken as a disable
+		{body: `{}`, fails: true},
+		{body: `{"TTL": "twenty minutes"}`, fails: true},
+		{body: `"yes"`, fails: true},
+	}
+	for _, test := range tests {
+		request := enableRequest{}
+		err := json.Unmarshal([]byte(test.body), &request)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.body, request)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.body, err)
+			continue
+		}
+		if request.Enable != test.enable || request.TTL.Duration != test.ttl {
+			t.Errorf("%s: expected Enable %v and TTL %s, got %+v", test.body, test.enable, test.ttl, request)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	setConfig(&configuration{
+		MaxTTL: duration{8 * time.Hour},
+		TTL: ttlConfiguration{
+			Default:    duration{time.Hour},
+			Users:      map[string]duration{"contractor": {2 * time.Hour}, "generous": {24 * time.Hour}},
+			Interfaces: map[string]duration{"10.0.0.2": {30 * time.Minute}},
+		},
+	})
+	now := time.Date(2016, 1, 12, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		ip      string
+		user    string
+		request enableRequest
+		expire  time.Duration
+		clamped bool
+		fails   bool
+	}{
+		{name: "default ttl", ip: "10.0.0.1", request: enableRequest{Enable: true}, expire: time.Hour},
+		{name: "ttl", ip: "10.0.0.1", request: enableRequest{TTL: duration{3 * time.Hour}}, expire: 3 * time.Hour},
+		{name: "until", ip: "10.0.0.1", request: enableRequest{Until: now.Add(90 * time.Minute)}, expire: 90 * time.Minute},
+		{name: "max ttl", ip: "10.0.0.1", request: enableRequest{TTL: duration{48 * time.Hour}}, expire: 8 * time.Hour, clamped: true},
+		{name: "user limit", ip: "10.0.0.1", user: "contractor", request: enableRequest{TTL: duration{3 * time.Hour}}, expire: 2 * time.Hour, clamped: true},
+		// A user's limit can't loosen max_ttl
+		{name: "user over max ttl", ip: "10.0.0.1", user: "generous", request: enableRequest{TTL: duration{12 * time.Hour}}, expire: 8 * time.Hour, clamped: true},
+		{name: "interface limit", ip: "10.0.0.2", request: enableRequest{Until: now.Add(time.Hour)}, expire: 30 * time.Minute, clamped: true},
+		// The interface is tighter than the user, and the default is cut down too
+		{name: "tightest limit", ip: "10.0.0.2", user: "contractor", request: enableRequest{Enable: true}, expire: 30 * time.Minute, clamped: true},
+		{name: "until in the past", ip: "10.0.0.1", request: enableRequest{Until: now.Add(-time.Minute)}, fails: true},
+		{name: "negative ttl", ip: "10.0.0.1", request: enableRequest{TTL: duration{-time.Minute}}, fails: true},
+	}
+	for _, test := range tests {
+		expire, clamped, err := test.request.expiry(test.ip, test.user, now)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, expire)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !expire.Equal(now.Add(test.expire)) || clamped != test.clamped {
+			t.Errorf("%s: expected %s (clamped %v), got %s (clamped %v)", test.name, now.Add(test.expire), test.clamped, expire, clamped)
+		}
+	}
+
+	// Without a default it's as long as they're allowed
+	setConfig(&configuration{MaxTTL: duration{8 * time.Hour}, TTL: ttlConfiguration{Users: map[string]duration{"contractor": {2 * time.Hour}}}})
+	if expire, clamped, _ := (&enableRequest{Enable: true}).expiry("10.0.0.1", "contractor", now); !expire.Equal(now.Add(2*time.Hour)) || clamped {
+		t.Errorf("Expected the user's limit without a default, got %s (clamped %v)", expire, clamped)
+	}
+}